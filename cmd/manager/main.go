@@ -22,25 +22,41 @@ import (
 	"io/ioutil"
 	"k8s.io/klog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"admiralty.io/multicluster-controller/pkg/cluster"
+	"admiralty.io/multicluster-controller/pkg/controller"
 	"admiralty.io/multicluster-controller/pkg/manager"
 	"admiralty.io/multicluster-service-account/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	// extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	// "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	kscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/kubernetes/cmd/cloud-controller-manager/app"
 	"k8s.io/sample-controller/pkg/signals"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/ccm"
 	inner "github.com/ivan4th/virtletlb/pkg/controller/inner"
 	outer "github.com/ivan4th/virtletlb/pkg/controller/outer"
+	"github.com/ivan4th/virtletlb/pkg/keyfilter"
+	"github.com/ivan4th/virtletlb/pkg/locator"
 	pubconfig "github.com/ivan4th/virtletlb/pkg/pubconfig"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
 )
 
 const (
@@ -86,6 +102,28 @@ func OuterClusterConfigInsideVM() (*rest.Config, string, error) {
 	}, string(ns), nil
 }
 
+var (
+	networkPolicies     = flag.Bool("network-policies", false, "outer: enforce loadBalancerSourceRanges using NetworkPolicies")
+	controllerPodLabels = flag.String("controller-pod-labels", "control-plane=virtletlb-outer", "outer: comma-separated key=value labels of the outer controller pods which are allowed to health check the VM pods by the NetworkPolicies")
+	annotationAllowList = flag.String("annotation-allowlist", "", "outer: comma-separated list of inner service annotations to copy to the outer services ('prefix*' and '^regex' patterns are supported)")
+	labelAllowList      = flag.String("label-allowlist", "", "outer: comma-separated list of inner service labels to copy to the outer services ('prefix*' and '^regex' patterns are supported)")
+	clusterID           = flag.String("cluster-id", "", "inner, ccm: the ID of the inner cluster (defaults to the name of the StatefulSet of the VMs, derived from the node names)")
+	sweepInterval       = flag.Duration("sweep-interval", 10*time.Minute, "the interval between the orphan sweeps (0 means only sweeping at startup)")
+	sweepDeleteQPS      = flag.Float64("sweep-delete-qps", 1, "the maximum rate of the deletions done by the orphan sweeper (0 means no limit)")
+	podRefKey           = flag.String("pod-ref-key", "virtletlb.virtlet.cloud/pod", "inner, ccm: the key of the node label or annotation that holds the name or the UID of the outer pod of the node, for the pod-ref node locator")
+	nodeLocator         = flag.String("node-locator", locator.NodeName, "outer: the way to find the VM pods for the inner nodes: "+strings.Join(locator.Kinds, ", "))
+	backend             = flag.String("backend", locator.StatefulSetBackend, "outer, ccm: the kind of the VMs or nested cluster nodes in the outer namespace: "+strings.Join(locator.BackendKinds, ", "))
+	backendLabel        = flag.String("backend-label", locator.DefaultBackendLabel, "outer, ccm: the label of the outer pods that holds the backend name, for the pod backend")
+	exposeNodePorts     = flag.Bool("expose-node-ports", false, "inner: expose all the inner NodePort services through the outer cluster, not just the ones annotated with virtletlb.virtlet.cloud/expose-node-port=true")
+	ingressService      = flag.String("ingress-service", "", "inner: namespace/name of the service of the inner ingress controller; enables mirroring of the inner extensions/v1beta1 Ingresses to the outer cluster (Kubernetes 1.21 or older)")
+	ingressPort         = flag.String("ingress-port", "80", "inner: the name or the number of the HTTP port of the ingress controller service")
+	ingresses           = flag.Bool("ingresses", false, "outer: make outer extensions/v1beta1 Ingresses for the InnerIngresses (Kubernetes 1.21 or older)")
+	ingressClass        = flag.String("ingress-class", "", "inner: the kubernetes.io/ingress.class of the inner Ingresses to mirror (the ones without the class are mirrored, too); outer: the kubernetes.io/ingress.class annotation of the outer Ingresses")
+	importServices      = flag.Bool("import", false, "inner: import the outer services annotated with virtletlb.virtlet.cloud/import into the inner cluster")
+	importNamespace     = flag.String("import-namespace", "default", "inner: the default inner namespace of the imported outer services")
+	metricsAddr         = flag.String("metrics-addr", ":8080", "the address to serve Prometheus metrics on (empty string disables the metrics)")
+)
+
 // var (
 // 	scheme = runtime.NewScheme()
 // )
@@ -117,6 +155,50 @@ func getOuterConfig(spec string) (*rest.Config, string, error) {
 	}
 }
 
+// newDirectClient returns a client that doesn't use the caches
+func newDirectClient(cfg *rest.Config) client.Client {
+	c, err := client.New(cfg, client.Options{Scheme: kscheme.Scheme})
+	if err != nil {
+		klog.Fatalf("couldn't create client: %v", err)
+	}
+	return c
+}
+
+// getClusterID returns the ID of the inner cluster, either the one
+// specified via the flag or the one derived from the node names
+func getClusterID(cfg *rest.Config) (string, error) {
+	if *clusterID != "" {
+		return *clusterID, inner.ValidateClusterID(*clusterID)
+	}
+	id, err := inner.DetectClusterID(newDirectClient(cfg))
+	if err != nil {
+		return "", fmt.Errorf("couldn't detect the cluster ID, please specify -cluster-id: %v", err)
+	}
+	return id, nil
+}
+
+// serveMetrics serves Prometheus metrics on the specified address
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("error serving metrics: %v", err)
+	}
+}
+
+// newEventRecorder returns an EventRecorder that records the events
+// in the cluster specified by cfg
+func newEventRecorder(cfg *rest.Config, component string) (record.EventRecorder, error) {
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create clientset: %v", err)
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(kscheme.Scheme, v1.EventSource{Component: component}), nil
+}
+
 func main() {
 	// https://github.com/kubernetes-sigs/kubebuilder/issues/491#issuecomment-459474907
 	// FIXME: should be able to specify the scheme for Cluster (?)
@@ -144,6 +226,11 @@ func main() {
 
 	// TODO: use cobra
 	m := manager.New()
+	sweepOpts := sweeper.Options{
+		Interval:  *sweepInterval,
+		DeleteQPS: *sweepDeleteQPS,
+	}
+	var sweepers []*sweeper.Sweeper
 	command := flag.Arg(0)
 	switch command {
 	case "inner":
@@ -165,12 +252,85 @@ func main() {
 		}
 		outerCluster := cluster.New(dstCtx, outerCfg, cluster.Options{})
 
-		co, err := inner.NewController(innerCluster, outerCluster, outerNs)
+		recorder, err := newEventRecorder(innerCfg, "virtletlb-inner")
+		if err != nil {
+			klog.Fatal(err)
+		}
+
+		id, err := getClusterID(innerCfg)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		klog.Infof("inner cluster ID: %s", id)
+
+		opts := inner.Options{
+			ClusterID:       id,
+			PodRefKey:       *podRefKey,
+			Recorder:        recorder,
+			ExposeNodePorts: *exposeNodePorts,
+		}
+		co, err := inner.NewController(innerCluster, outerCluster, outerNs, opts)
 		if err != nil {
 			klog.Fatalf("creating dest controller: %v", err)
 		}
 
 		m.AddController(co)
+		ingressOpts := inner.IngressOptions{
+			Options:      opts,
+			IngressPort:  *ingressPort,
+			IngressClass: *ingressClass,
+		}
+		// without the ingress controller, the ingress sweeper
+		// cleans up after its earlier runs
+		var ico *controller.Controller
+		if *ingressService != "" {
+			parts := strings.Split(*ingressService, "/")
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				klog.Fatalf("bad ingress service %q, must be namespace/name", *ingressService)
+			}
+			ingressOpts.IngressService = types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+			ico, err = inner.NewIngressController(innerCluster, outerCluster, outerNs, ingressOpts)
+			if err != nil {
+				klog.Fatalf("creating ingress controller: %v", err)
+			}
+			m.AddController(ico)
+		}
+		sweepers = append(sweepers, inner.NewSweeper(co, innerCluster.GetClusterName(), newDirectClient(innerCfg), newDirectClient(outerCfg), outerNs, opts, sweepOpts))
+		sweepers = append(sweepers, inner.NewIngressSweeper(ico, innerCluster.GetClusterName(), newDirectClient(innerCfg), newDirectClient(outerCfg), outerNs, ingressOpts, sweepOpts))
+		if *importServices {
+			importOpts := inner.ImportOptions{Namespace: *importNamespace}
+			importCo, err := inner.NewImportController(outerCluster, innerCluster, outerNs, importOpts)
+			if err != nil {
+				klog.Fatalf("creating import controller: %v", err)
+			}
+			m.AddController(importCo)
+			sweepers = append(sweepers, inner.NewImportSweeper(importCo, outerCluster.GetClusterName(), newDirectClient(outerCfg), newDirectClient(innerCfg), outerNs, importOpts, sweepOpts))
+		}
+	case "ccm":
+		if flag.NArg() < 2 {
+			klog.Fatalf("Usage: manager ccm outer-ctx|OUTCLUSTER [cloud-controller-manager flags...]")
+		}
+
+		outerCfg, outerNs, err := getOuterConfig(flag.Arg(1))
+		if err != nil {
+			klog.Fatal(err)
+		}
+		ccm.Register(newDirectClient(outerCfg), outerNs, ccm.Options{
+			ClusterID:    *clusterID,
+			PodRefKey:    *podRefKey,
+			Backend:      *backend,
+			BackendLabel: *backendLabel,
+			Sweep:        sweepOpts,
+		})
+
+		// cloud-controller-manager runs the service controller
+		// which drives the cloud provider
+		command := app.NewCloudControllerManagerCommand()
+		command.SetArgs(append([]string{"--cloud-provider=" + ccm.ProviderName}, flag.Args()[2:]...))
+		if err := command.Execute(); err != nil {
+			klog.Fatal(err)
+		}
+		os.Exit(0)
 	case "outer":
 		if flag.NArg() != 2 {
 			klog.Fatalf("Usage: manager outer outer-ctx|INCLUSTER")
@@ -183,12 +343,45 @@ func main() {
 		}
 		outerCluster := cluster.New(srcCtx, cfg, cluster.Options{})
 
-		co, err := outer.NewController(outerCluster, outerNs)
+		annotationFilter, err := keyfilter.Parse(*annotationAllowList)
+		if err != nil {
+			klog.Fatalf("bad annotation allow-list: %v", err)
+		}
+		labelFilter, err := keyfilter.Parse(*labelAllowList)
+		if err != nil {
+			klog.Fatalf("bad label allow-list: %v", err)
+		}
+
+		controllerLabels, err := labels.ConvertSelectorToLabelsMap(*controllerPodLabels)
+		if err != nil {
+			klog.Fatalf("bad controller pod labels: %v", err)
+		}
+
+		opts := outer.Options{
+			NetworkPolicies:  *networkPolicies,
+			ControllerLabels: controllerLabels,
+			AnnotationFilter: annotationFilter,
+			LabelFilter:      labelFilter,
+			NodeLocator:      *nodeLocator,
+			Backend:          *backend,
+			BackendLabel:     *backendLabel,
+			Ingresses:        *ingresses,
+			IngressClass:     *ingressClass,
+		}
+		co, err := outer.NewController(outerCluster, outerNs, opts)
 		if err != nil {
 			klog.Fatalf("creating dest controller: %v", err)
 		}
 
 		m.AddController(co)
+		if opts.Ingresses {
+			ico, err := outer.NewIngressController(outerCluster, outerNs, opts)
+			if err != nil {
+				klog.Fatalf("creating ingress controller: %v", err)
+			}
+			m.AddController(ico)
+		}
+		sweepers = append(sweepers, outer.NewSweeper(co, outerCluster.GetClusterName(), newDirectClient(cfg), outerNs, opts, sweepOpts))
 	case "publish-config":
 		if flag.NArg() != 3 {
 			klog.Fatalf("Usage: publish-config outer-ctx|OUTCLUSTER config-path")
@@ -206,7 +399,16 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err := m.Start(signals.SetupSignalHandler()); err != nil {
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	stop := signals.SetupSignalHandler()
+	for _, s := range sweepers {
+		go s.Run(stop)
+	}
+
+	if err := m.Start(stop); err != nil {
 		klog.Fatalf("while or after starting manager: %v", err)
 	}
 }
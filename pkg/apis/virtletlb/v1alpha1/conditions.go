@@ -0,0 +1,61 @@
+/*
+Copyright 2019 Mirantis.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetCondition returns the condition of the specified type or nil
+// if there's no such condition
+func (s *InnerServiceStatus) GetCondition(conditionType InnerServiceConditionType) *InnerServiceCondition {
+	for n := range s.Conditions {
+		if s.Conditions[n].Type == conditionType {
+			return &s.Conditions[n]
+		}
+	}
+	return nil
+}
+
+// SetCondition sets the condition of the specified type, keeping
+// its LastTransitionTime unless the status of the condition changes.
+// It returns true if the condition was changed.
+func (s *InnerServiceStatus) SetCondition(conditionType InnerServiceConditionType, status v1.ConditionStatus, reason, message string) bool {
+	c := InnerServiceCondition{
+		Type:    conditionType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+	cur := s.GetCondition(conditionType)
+	if cur == nil {
+		c.LastTransitionTime = metav1.Now()
+		s.Conditions = append(s.Conditions, c)
+		return true
+	}
+	if cur.Status == status {
+		if cur.Reason == reason && cur.Message == message {
+			return false
+		}
+		c.LastTransitionTime = cur.LastTransitionTime
+	} else {
+		c.LastTransitionTime = metav1.Now()
+	}
+	*cur = c
+	return true
+}
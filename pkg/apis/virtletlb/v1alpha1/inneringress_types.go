@@ -0,0 +1,113 @@
+/*
+Copyright 2019 Mirantis.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InnerIngressLabel is set on the outer objects made for the
+// InnerIngresses. Its value is the name of the InnerIngress.
+const InnerIngressLabel = "virtletlb.virtlet.cloud/inner-ingress"
+
+// InnerIngressRule routes the HTTP requests for a host to the
+// ingress controller of the inner cluster
+type InnerIngressRule struct {
+	// The host name. Empty host matches all the requests.
+	// +optional
+	Host string `json:"host,omitempty"`
+	// The paths of the requests. Empty list matches all the
+	// paths.
+	// +optional
+	Paths []string `json:"paths,omitempty"`
+}
+
+// InnerIngressSpec defines the desired state of an InnerIngress
+type InnerIngressSpec struct {
+	// The ID of the inner cluster the ingress belongs to.
+	// +optional
+	ClusterID string `json:"clusterID,omitempty"`
+
+	// The namespace and the name of the inner ingress.
+	// +optional
+	IngressNamespace string `json:"ingressNamespace,omitempty"`
+	// +optional
+	IngressName string `json:"ingressName,omitempty"`
+
+	// The rules of the inner ingress. The outer ingress routes the
+	// matching requests to the inner ingress controller which does
+	// the rest of the routing.
+	// +optional
+	Rules []InnerIngressRule `json:"rules,omitempty"`
+
+	// The node port of the inner ingress controller's service that
+	// receives the HTTP traffic.
+	NodePort int32 `json:"nodePort"`
+
+	// The names of the inner cluster nodes that can serve the
+	// node port.
+	// +optional
+	NodeNames []string `json:"nodeNames,omitempty"`
+
+	// The details of the nodes listed in NodeNames, in the same
+	// order.
+	// +optional
+	Nodes []InnerServiceNode `json:"nodes,omitempty"`
+}
+
+// InnerIngressStatus defines the observed state of InnerIngress
+type InnerIngressStatus struct {
+	// LoadBalancer contains the current status of the outer
+	// ingress' load balancer.
+	// +optional
+	LoadBalancer v1.LoadBalancerStatus `json:"loadBalancer,omitempty"`
+
+	// The generation of the InnerIngress that was last processed
+	// by the outer controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// InnerIngress is the Schema for the inneringresses API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Address",type="string",JSONPath=".status.loadBalancer.ingress[0].ip"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type InnerIngress struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   InnerIngressSpec   `json:"spec,omitempty"`
+	Status InnerIngressStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// InnerIngressList contains a list of InnerIngress
+type InnerIngressList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []InnerIngress `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&InnerIngress{}, &InnerIngressList{})
+}
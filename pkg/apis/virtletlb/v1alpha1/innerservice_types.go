@@ -24,6 +24,11 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// ClusterLabel is set on the InnerServices and on the outer objects
+// made for them. Its value is the ID of the inner cluster the
+// objects belong to.
+const ClusterLabel = "virtletlb.virtlet.cloud/cluster"
+
 // InnerServicePort defines an inner service port
 type InnerServicePort struct {
 	// The name of this port within the service. This must be a DNS_LABEL.
@@ -47,15 +52,169 @@ type InnerServicePort struct {
 	NodePort int32 `json:"nodePort,omitempty"`
 }
 
+// InnerServiceNode describes an inner cluster node. The outer
+// controller uses this information to find the outer pod that
+// corresponds to the node.
+type InnerServiceNode struct {
+	// The name of the node.
+	Name string `json:"name"`
+	// The spec.providerID of the node.
+	// +optional
+	ProviderID string `json:"providerID,omitempty"`
+	// The InternalIP of the node.
+	// +optional
+	InternalIP string `json:"internalIP,omitempty"`
+	// The name or the UID of the outer pod taken from the node's
+	// label or annotation.
+	// +optional
+	PodRef string `json:"podRef,omitempty"`
+}
+
 // InnerServiceSpec defines the desired state of an InnerService
 type InnerServiceSpec struct {
+	// The ID of the inner cluster the service belongs to. Several
+	// inner clusters may share the same outer namespace, and the
+	// controllers only touch the objects that belong to their
+	// cluster.
+	// +optional
+	ClusterID string `json:"clusterID,omitempty"`
+
+	// The namespace and the name of the inner service. The name of
+	// the InnerService is derived from these and the cluster ID,
+	// and may be shortened, so they're needed to find the inner
+	// service for the InnerService.
+	// +optional
+	ServiceNamespace string `json:"serviceNamespace,omitempty"`
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// The type of the outer service, "LoadBalancer" (the default)
+	// or "NodePort". The latter is used for the inner NodePort
+	// services that are exposed through the outer cluster.
+	// +optional
+	// +kubebuilder:validation:Enum=LoadBalancer,NodePort
+	Type v1.ServiceType `json:"type,omitempty"`
+
+	// The names of the inner cluster nodes that can serve the
+	// inner service's node ports.
 	NodeNames []string           `json:"nodeNames,omitempty"`
 	Ports     []InnerServicePort `json:"ports,omitempty"`
+
+	// The details of the nodes listed in NodeNames, in the same
+	// order.
+	// +optional
+	Nodes []InnerServiceNode `json:"nodes,omitempty"`
+
+	// The externalTrafficPolicy of the inner service. For "Local",
+	// NodeNames only include the nodes which host the endpoints of
+	// the inner service, and the outer service uses "Local" policy
+	// too so as to preserve client source IPs. For "Cluster", all
+	// the schedulable inner nodes are used.
+	// +optional
+	ExternalTrafficPolicy v1.ServiceExternalTrafficPolicyType `json:"externalTrafficPolicy,omitempty"`
+
+	// The healthCheckNodePort of the inner service. It's only set
+	// for "Local" externalTrafficPolicy. The outer controller uses
+	// it to probe the inner nodes and excludes the ones that fail
+	// the health check from the outer service's backends.
+	// +optional
+	HealthCheckNodePort int32 `json:"healthCheckNodePort,omitempty"`
+
+	// The load balancer IP requested for the inner service, either
+	// via its spec.loadBalancerIP or MetalLB annotation. It's passed
+	// to the outer service's spec.loadBalancerIP.
+	// +optional
+	LoadBalancerIP string `json:"loadBalancerIP,omitempty"`
+
+	// The CIDRs the clients of the outer load balancer are
+	// restricted to, taken from the inner service's
+	// spec.loadBalancerSourceRanges.
+	// +optional
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+
+	// The labels of the inner service. The outer controller copies
+	// the ones allowed by its label allow-list to the outer service.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// The annotations of the inner service. The outer controller
+	// copies the ones allowed by its annotation allow-list to the
+	// outer service.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// The sessionAffinity of the inner service, "ClientIP" or
+	// "None". It's applied to the outer service.
+	// +optional
+	SessionAffinity v1.ServiceAffinity `json:"sessionAffinity,omitempty"`
+
+	// The sessionAffinityConfig of the inner service.
+	// +optional
+	SessionAffinityConfig *v1.SessionAffinityConfig `json:"sessionAffinityConfig,omitempty"`
+}
+
+// InnerServiceConditionType is a valid value for InnerServiceCondition.Type
+type InnerServiceConditionType string
+
+const (
+	// InnerServiceSynced means that the outer service and its
+	// backends match the InnerService. Set by the outer controller.
+	InnerServiceSynced InnerServiceConditionType = "Synced"
+	// InnerServiceBackendsReady means that the outer service has
+	// at least one ready VM pod to send the traffic to. Set by the
+	// outer controller.
+	InnerServiceBackendsReady InnerServiceConditionType = "BackendsReady"
+	// InnerServiceAddressAssigned means that the outer load balancer
+	// has assigned the address(es) to the service, which includes
+	// the requested loadBalancerIP, if any. Set by the outer
+	// controller.
+	InnerServiceAddressAssigned InnerServiceConditionType = "AddressAssigned"
+	// InnerServiceNodesAvailable means that there are inner nodes
+	// that can serve the inner service. Set by the inner controller.
+	InnerServiceNodesAvailable InnerServiceConditionType = "NodesAvailable"
+)
+
+// InnerServiceCondition describes the state of an InnerService
+// at a certain point
+type InnerServiceCondition struct {
+	// Type of the condition.
+	Type InnerServiceConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	Status v1.ConditionStatus `json:"status"`
+	// The last time the condition transitioned from one status
+	// to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// The reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// A human readable message indicating details about the
+	// transition.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // InnerServiceStatus defines the observed state of InnerService
 type InnerServiceStatus struct {
-	LoadBalancerIP string
+	// LoadBalancer contains the current status of the outer
+	// service's load balancer. It lists all of its ingress points,
+	// which may include IPv4 and IPv6 addresses and hostnames.
+	// +optional
+	LoadBalancer v1.LoadBalancerStatus `json:"loadBalancer,omitempty"`
+
+	// The ports of the outer service. Their NodePort is the node
+	// port allocated in the outer cluster.
+	// +optional
+	NodePorts []InnerServicePort `json:"nodePorts,omitempty"`
+
+	// The generation of the InnerService that was last processed
+	// by the outer controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The current conditions of the InnerService.
+	// +optional
+	Conditions []InnerServiceCondition `json:"conditions,omitempty"`
 }
 
 // +genclient
@@ -63,6 +222,12 @@ type InnerServiceStatus struct {
 
 // InnerService is the Schema for the innerservices API
 // +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Address",type="string",JSONPath=".status.loadBalancer.ingress[0].ip"
+// +kubebuilder:printcolumn:name="Synced",type="string",JSONPath=".status.conditions[?(@.type==\"Synced\")].status"
+// +kubebuilder:printcolumn:name="Backends",type="string",JSONPath=".status.conditions[?(@.type==\"BackendsReady\")].status"
+// +kubebuilder:printcolumn:name="Assigned",type="string",JSONPath=".status.conditions[?(@.type==\"AddressAssigned\")].status"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 type InnerService struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -0,0 +1,170 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ccm implements a Kubernetes cloud provider for the inner
+// clusters which is run by cloud-controller-manager instead of the
+// inner controller. Its LoadBalancer makes InnerServices in the outer
+// cluster for the inner LoadBalancer services, which are then handled
+// by the outer controller as usual.
+package ccm
+
+import (
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	kscheme "k8s.io/client-go/kubernetes/scheme"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/controller/inner"
+	"github.com/ivan4th/virtletlb/pkg/locator"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+// ProviderName is the name of the cloud provider to be passed to
+// cloud-controller-manager via --cloud-provider flag
+const ProviderName = "virtletlb"
+
+// Options specifies the options of the cloud provider
+type Options struct {
+	// ClusterID is the ID of the inner cluster. If it's empty,
+	// it's derived from the names of the inner nodes during the
+	// initialization of the cloud provider.
+	ClusterID string
+	// PodRefKey is the key of the node label or annotation that
+	// holds the name or the UID of the outer pod of the node
+	PodRefKey string
+	// Backend specifies the kind of the VMs or nested cluster nodes
+	// in the outer cluster, see locator.Backend. The default is
+	// locator.StatefulSetBackend.
+	Backend string
+	// BackendLabel specifies the label that holds the backend name
+	// for locator.PodBackend
+	BackendLabel string
+	// Sweep specifies the options of the orphan sweeper that
+	// deletes the InnerServices of the deleted inner services
+	Sweep sweeper.Options
+}
+
+type cloud struct {
+	outer           client.Client
+	inner           client.Client
+	targetNamespace string
+	clusterID       string
+	podRefKey       string
+	backend         locator.Backend
+	sweepOpts       sweeper.Options
+}
+
+var _ cloudprovider.Interface = &cloud{}
+
+// New returns a cloud provider that makes InnerServices in the
+// target namespace of the outer cluster using the specified client.
+// The client must read directly from the outer apiserver.
+func New(outer client.Client, targetNamespace string, opts Options) (cloudprovider.Interface, error) {
+	backendKind := opts.Backend
+	if backendKind == "" {
+		backendKind = locator.StatefulSetBackend
+	}
+	backend, err := locator.NewBackend(backendKind, outer, targetNamespace, opts.BackendLabel)
+	if err != nil {
+		return nil, err
+	}
+	return &cloud{
+		outer:           outer,
+		targetNamespace: targetNamespace,
+		clusterID:       opts.ClusterID,
+		podRefKey:       opts.PodRefKey,
+		backend:         backend,
+		sweepOpts:       opts.Sweep,
+	}, nil
+}
+
+// Register registers the cloud provider made by New under
+// ProviderName, so that cloud-controller-manager can use it
+func Register(outer client.Client, targetNamespace string, opts Options) {
+	cloudprovider.RegisterCloudProvider(ProviderName, func(config io.Reader) (cloudprovider.Interface, error) {
+		return New(outer, targetNamespace, opts)
+	})
+}
+
+// Initialize implements Initialize method of cloudprovider.Interface
+func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	cfg, err := clientBuilder.Config(ProviderName)
+	if err != nil {
+		klog.Fatalf("error initializing %s cloud provider: %v", ProviderName, err)
+	}
+	c.inner, err = client.New(cfg, client.Options{Scheme: kscheme.Scheme})
+	if err != nil {
+		klog.Fatalf("couldn't create client: %v", err)
+	}
+	if err := c.initClusterID(); err != nil {
+		klog.Fatalf("error initializing %s cloud provider: %v", ProviderName, err)
+	}
+	klog.Infof("inner cluster ID: %s", c.clusterID)
+
+	go wait.Until(c.syncZones, zoneSyncInterval, stop)
+	go c.newSweeper().Run(stop)
+}
+
+func (c *cloud) initClusterID() error {
+	if c.clusterID != "" {
+		return inner.ValidateClusterID(c.clusterID)
+	}
+	var err error
+	c.clusterID, err = inner.DetectClusterID(c.inner)
+	if err != nil {
+		return fmt.Errorf("couldn't detect the cluster ID, please specify -cluster-id: %v", err)
+	}
+	return nil
+}
+
+// LoadBalancer implements LoadBalancer method of cloudprovider.Interface
+func (c *cloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
+	return &loadBalancer{c}, true
+}
+
+// Instances implements Instances method of cloudprovider.Interface
+func (c *cloud) Instances() (cloudprovider.Instances, bool) {
+	return &instances{c}, true
+}
+
+// Zones implements Zones method of cloudprovider.Interface
+func (c *cloud) Zones() (cloudprovider.Zones, bool) {
+	return &zones{c}, true
+}
+
+// Clusters implements Clusters method of cloudprovider.Interface
+func (c *cloud) Clusters() (cloudprovider.Clusters, bool) {
+	return nil, false
+}
+
+// Routes implements Routes method of cloudprovider.Interface
+func (c *cloud) Routes() (cloudprovider.Routes, bool) {
+	return nil, false
+}
+
+// ProviderName implements ProviderName method of cloudprovider.Interface
+func (c *cloud) ProviderName() string {
+	return ProviderName
+}
+
+// HasClusterID implements HasClusterID method of cloudprovider.Interface
+func (c *cloud) HasClusterID() bool {
+	return true
+}
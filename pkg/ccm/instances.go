@@ -0,0 +1,194 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+
+	"github.com/ivan4th/virtletlb/pkg/locator"
+)
+
+const (
+	// instanceTypeAnnotation may be set on the outer pods to
+	// override the instance type that's derived from their
+	// resources
+	instanceTypeAnnotation = "virtletlb.virtlet.cloud/instance-type"
+	// vcpuCountAnnotation specifies the number of vCPUs of a
+	// Virtlet VM
+	vcpuCountAnnotation = "VirtletVCPUCount"
+)
+
+// instances implements cloudprovider.Instances using the outer pods
+// of the backends, see locator.Backend. The inner node names are
+// the backend names, and the instance IDs are <namespace>/<backend>,
+// so the provider IDs of the nodes look like
+// virtletlb://namespace/backend-name, which is understood by the
+// provider-id node locator of the outer controller. The backend name
+// is the pod name for the StatefulSet backend, the VMI name for the
+// KubeVirt one and the label value for the pod one.
+type instances struct {
+	*cloud
+}
+
+// pod returns the outer pod of the backend, or InstanceNotFound
+// error if there's no such pod
+func (c *cloud) pod(name string) (*v1.Pod, error) {
+	pod, err := c.backend.Pod(name)
+	switch {
+	case err != nil:
+		return nil, err
+	case pod == nil:
+		return nil, cloudprovider.InstanceNotFound
+	}
+	return pod, nil
+}
+
+// podByProviderID returns the outer pod for the provider ID, or
+// InstanceNotFound error if there's no such pod. The provider IDs
+// that refer to other namespaces have no pods, too.
+func (c *cloud) podByProviderID(providerID string) (*v1.Pod, error) {
+	name := locator.ParseProviderID(providerID, c.targetNamespace)
+	if name == "" {
+		klog.V(1).Infof("provider ID %q doesn't refer to the namespace %q", providerID, c.targetNamespace)
+		return nil, cloudprovider.InstanceNotFound
+	}
+	return c.pod(name)
+}
+
+func nodeAddresses(name string, pod *v1.Pod) []v1.NodeAddress {
+	addrs := []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: name},
+	}
+	if pod.Status.PodIP != "" {
+		addrs = append(addrs, v1.NodeAddress{Type: v1.NodeInternalIP, Address: pod.Status.PodIP})
+	}
+	return addrs
+}
+
+// instanceType returns the instance type of the outer pod, which is
+// either specified by the instance type annotation or derived from
+// the number of vCPUs and the memory limit of the pod, e.g. 2cpu-1Gi
+func instanceType(pod *v1.Pod) string {
+	if t := pod.Annotations[instanceTypeAnnotation]; t != "" {
+		return t
+	}
+	var cpu, memory resource.Quantity
+	for _, c := range pod.Spec.Containers {
+		cpu.Add(c.Resources.Limits[v1.ResourceCPU])
+		memory.Add(c.Resources.Limits[v1.ResourceMemory])
+	}
+	cpus := (cpu.MilliValue() + 999) / 1000
+	if n, err := strconv.ParseInt(pod.Annotations[vcpuCountAnnotation], 10, 64); err == nil && n > 0 {
+		cpus = n
+	}
+	if cpus == 0 {
+		cpus = 1
+	}
+	if memory.IsZero() {
+		return fmt.Sprintf("%dcpu", cpus)
+	}
+	return fmt.Sprintf("%dcpu-%s", cpus, memory.String())
+}
+
+// NodeAddresses implements NodeAddresses method of cloudprovider.Instances
+func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
+	pod, err := i.pod(string(name))
+	if err != nil {
+		return nil, err
+	}
+	return nodeAddresses(string(name), pod), nil
+}
+
+// NodeAddressesByProviderID implements NodeAddressesByProviderID method of cloudprovider.Instances
+func (i *instances) NodeAddressesByProviderID(ctx context.Context, providerID string) ([]v1.NodeAddress, error) {
+	pod, err := i.podByProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
+	return nodeAddresses(i.backend.Name(pod), pod), nil
+}
+
+// InstanceID implements InstanceID method of cloudprovider.Instances
+func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (string, error) {
+	if _, err := i.pod(string(nodeName)); err != nil {
+		return "", err
+	}
+	return i.targetNamespace + "/" + string(nodeName), nil
+}
+
+// InstanceType implements InstanceType method of cloudprovider.Instances
+func (i *instances) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
+	pod, err := i.pod(string(name))
+	if err != nil {
+		return "", err
+	}
+	return instanceType(pod), nil
+}
+
+// InstanceTypeByProviderID implements InstanceTypeByProviderID method of cloudprovider.Instances
+func (i *instances) InstanceTypeByProviderID(ctx context.Context, providerID string) (string, error) {
+	pod, err := i.podByProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	return instanceType(pod), nil
+}
+
+// AddSSHKeyToAllInstances implements AddSSHKeyToAllInstances method of cloudprovider.Instances
+func (i *instances) AddSSHKeyToAllInstances(ctx context.Context, user string, keyData []byte) error {
+	return cloudprovider.NotImplemented
+}
+
+// CurrentNodeName implements CurrentNodeName method of cloudprovider.Instances
+func (i *instances) CurrentNodeName(ctx context.Context, hostname string) (types.NodeName, error) {
+	return types.NodeName(hostname), nil
+}
+
+// InstanceExistsByProviderID implements InstanceExistsByProviderID
+// method of cloudprovider.Instances. The instance exists as long as
+// its outer pod does, so the inner nodes are deleted together with
+// their VMs.
+func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
+	_, err := i.podByProviderID(providerID)
+	switch {
+	case err == cloudprovider.InstanceNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// InstanceShutdownByProviderID implements
+// InstanceShutdownByProviderID method of cloudprovider.Instances.
+// The instance is considered to be shut down if its outer pod is
+// being deleted or has terminated.
+func (i *instances) InstanceShutdownByProviderID(ctx context.Context, providerID string) (bool, error) {
+	pod, err := i.podByProviderID(providerID)
+	if err != nil {
+		return false, err
+	}
+	return !locator.PodAlive(pod), nil
+}
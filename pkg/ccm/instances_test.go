@@ -0,0 +1,189 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	cloudprovider "k8s.io/cloud-provider"
+
+	"github.com/ivan4th/virtletlb/pkg/locator"
+)
+
+func newTestInstances(t *testing.T, pods ...runtime.Object) *instances {
+	c := newTestCloud(t, pods, nil)
+	var err error
+	c.backend, err = locator.NewBackend(locator.StatefulSetBackend, c.outer, "outer", "")
+	if err != nil {
+		t.Fatalf("error making the backend: %v", err)
+	}
+	i, _ := c.Instances()
+	return i.(*instances)
+}
+
+func runningPod(name, ip string) *v1.Pod {
+	pod := vmPod(name, "node-a")
+	pod.Status = v1.PodStatus{
+		Phase: v1.PodRunning,
+		PodIP: ip,
+	}
+	return pod
+}
+
+func limits(cpu, memory string) v1.Container {
+	l := v1.ResourceList{}
+	if cpu != "" {
+		l[v1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		l[v1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return v1.Container{Resources: v1.ResourceRequirements{Limits: l}}
+}
+
+func TestInstanceType(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		containers  []v1.Container
+		expected    string
+	}{
+		{
+			name:     "no limits",
+			expected: "1cpu",
+		},
+		{
+			name:       "cpu and memory limits",
+			containers: []v1.Container{limits("2", "1Gi")},
+			expected:   "2cpu-1Gi",
+		},
+		{
+			name:       "fractional cpu limit is rounded up",
+			containers: []v1.Container{limits("1500m", "")},
+			expected:   "2cpu",
+		},
+		{
+			name:       "limits of all the containers",
+			containers: []v1.Container{limits("1", "512Mi"), limits("1", "512Mi")},
+			expected:   "2cpu-1Gi",
+		},
+		{
+			name:        "Virtlet vCPU count",
+			annotations: map[string]string{vcpuCountAnnotation: "4"},
+			containers:  []v1.Container{limits("1", "2Gi")},
+			expected:    "4cpu-2Gi",
+		},
+		{
+			name: "explicit instance type",
+			annotations: map[string]string{
+				instanceTypeAnnotation: "large",
+				vcpuCountAnnotation:    "4",
+			},
+			containers: []v1.Container{limits("1", "2Gi")},
+			expected:   "large",
+		},
+	} {
+		pod := runningPod("k8s-0", "")
+		pod.Annotations = tc.annotations
+		pod.Spec.Containers = tc.containers
+		g.Expect(instanceType(pod)).To(gomega.Equal(tc.expected), tc.name)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	i := newTestInstances(t, runningPod("k8s-0", "10.244.1.10"), runningPod("k8s-1", ""))
+	ctx := context.TODO()
+
+	expected := []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "k8s-0"},
+		{Type: v1.NodeInternalIP, Address: "10.244.1.10"},
+	}
+	g.Expect(i.NodeAddresses(ctx, "k8s-0")).To(gomega.Equal(expected))
+	g.Expect(i.NodeAddressesByProviderID(ctx, "virtletlb://outer/k8s-0")).To(gomega.Equal(expected))
+	// the pod has no IP yet
+	g.Expect(i.NodeAddresses(ctx, "k8s-1")).To(gomega.Equal([]v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "k8s-1"},
+	}))
+
+	_, err := i.NodeAddresses(ctx, "k8s-2")
+	g.Expect(err).To(gomega.Equal(cloudprovider.InstanceNotFound))
+	_, err = i.NodeAddressesByProviderID(ctx, "virtletlb://other/k8s-0")
+	g.Expect(err).To(gomega.Equal(cloudprovider.InstanceNotFound))
+
+	g.Expect(i.InstanceID(ctx, "k8s-0")).To(gomega.Equal("outer/k8s-0"))
+}
+
+func TestInstanceExistence(t *testing.T) {
+	terminated := runningPod("k8s-1", "10.244.1.11")
+	terminated.Status.Phase = v1.PodFailed
+	deleting := runningPod("k8s-2", "10.244.1.12")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	i := newTestInstances(t, runningPod("k8s-0", "10.244.1.10"), terminated, deleting)
+
+	for _, tc := range []struct {
+		name, providerID string
+		exists, shutdown bool
+	}{
+		{
+			name:       "alive",
+			providerID: "virtletlb://outer/k8s-0",
+			exists:     true,
+		},
+		{
+			name:       "terminated",
+			providerID: "virtletlb://outer/k8s-1",
+			exists:     true,
+			shutdown:   true,
+		},
+		{
+			name:       "deleting",
+			providerID: "virtletlb://outer/k8s-2",
+			exists:     true,
+			shutdown:   true,
+		},
+		{
+			name:       "missing",
+			providerID: "virtletlb://outer/k8s-3",
+		},
+		{
+			name:       "another namespace",
+			providerID: "virtletlb://other/k8s-0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			ctx := context.TODO()
+			g.Expect(i.InstanceExistsByProviderID(ctx, tc.providerID)).To(gomega.Equal(tc.exists))
+			shutdown, err := i.InstanceShutdownByProviderID(ctx, tc.providerID)
+			if !tc.exists {
+				g.Expect(err).To(gomega.Equal(cloudprovider.InstanceNotFound))
+				return
+			}
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(shutdown).To(gomega.Equal(tc.shutdown))
+		})
+	}
+}
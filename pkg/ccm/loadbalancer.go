@@ -0,0 +1,188 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/controller/inner"
+)
+
+// loadBalancer implements cloudprovider.LoadBalancer using the
+// InnerServices. The clusterName passed by cloud-controller-manager
+// is ignored in favor of the cluster ID, which also identifies the
+// InnerServices of the inner cluster. The service controller retries
+// the operations that return errors, which is used to wait for the
+// outer controller to catch up.
+type loadBalancer struct {
+	*cloud
+}
+
+func (lb *loadBalancer) innerServiceName(svc *v1.Service) types.NamespacedName {
+	return inner.TargetNamespacedName(lb.clusterID, lb.targetNamespace, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name})
+}
+
+// getInnerService returns the InnerService of the service, or nil
+// if there's no such InnerService
+func (lb *loadBalancer) getInnerService(ctx context.Context, svc *v1.Service) (*v1alpha1.InnerService, error) {
+	nsn := lb.innerServiceName(svc)
+	isvc := &v1alpha1.InnerService{}
+	if err := lb.outer.Get(ctx, nsn, isvc); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !inner.OwnInnerService(isvc, lb.clusterID, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}) {
+		return nil, fmt.Errorf("InnerService %s doesn't belong to service %s/%s of cluster %q", nsn, svc.Namespace, svc.Name, lb.clusterID)
+	}
+	return isvc, nil
+}
+
+// GetLoadBalancer implements GetLoadBalancer method of cloudprovider.LoadBalancer
+func (lb *loadBalancer) GetLoadBalancer(ctx context.Context, clusterName string, svc *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
+	isvc, err := lb.getInnerService(ctx, svc)
+	if err != nil || isvc == nil {
+		return nil, false, err
+	}
+	return isvc.Status.LoadBalancer.DeepCopy(), true, nil
+}
+
+// GetLoadBalancerName implements GetLoadBalancerName method of cloudprovider.LoadBalancer
+func (lb *loadBalancer) GetLoadBalancerName(ctx context.Context, clusterName string, svc *v1.Service) string {
+	return lb.innerServiceName(svc).Name
+}
+
+// EnsureLoadBalancer implements EnsureLoadBalancer method of
+// cloudprovider.LoadBalancer. It fails until the outer controller
+// assigns the address to the outer service.
+func (lb *loadBalancer) EnsureLoadBalancer(ctx context.Context, clusterName string, svc *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	isvc, err := lb.syncInnerService(ctx, svc, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if isvc.Status.ObservedGeneration != isvc.Generation || len(isvc.Status.LoadBalancer.Ingress) == 0 {
+		return nil, fmt.Errorf("waiting for the outer service %s/%s to get load balancer address", isvc.Namespace, isvc.Name)
+	}
+	return loadBalancerStatus(isvc)
+}
+
+// UpdateLoadBalancer implements UpdateLoadBalancer method of cloudprovider.LoadBalancer
+func (lb *loadBalancer) UpdateLoadBalancer(ctx context.Context, clusterName string, svc *v1.Service, nodes []*v1.Node) error {
+	_, err := lb.syncInnerService(ctx, svc, nodes)
+	return err
+}
+
+// EnsureLoadBalancerDeleted implements EnsureLoadBalancerDeleted
+// method of cloudprovider.LoadBalancer. It fails until the outer
+// controller deletes the outer service and releases the InnerService.
+func (lb *loadBalancer) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, svc *v1.Service) error {
+	isvc, err := lb.getInnerService(ctx, svc)
+	if err != nil || isvc == nil {
+		return err
+	}
+	if isvc.DeletionTimestamp == nil {
+		klog.V(1).Infof("deleting InnerService %s/%s", isvc.Namespace, isvc.Name)
+		if err := lb.outer.Delete(ctx, isvc); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("waiting for InnerService %s/%s to be deleted", isvc.Namespace, isvc.Name)
+}
+
+// syncInnerService creates or updates the InnerService of the
+// service and returns it
+func (lb *loadBalancer) syncInnerService(ctx context.Context, svc *v1.Service, nodes []*v1.Node) (*v1alpha1.InnerService, error) {
+	var isvcNodes []v1alpha1.InnerServiceNode
+	for _, node := range nodes {
+		// the service controller may not know about all of
+		// the labels that exclude the nodes
+		if inner.NodeUsable(node) {
+			isvcNodes = append(isvcNodes, inner.NodeDetails(node, lb.podRefKey))
+		}
+	}
+	// the order of the nodes passed by the service controller
+	// may change, which mustn't cause the InnerService updates
+	sort.Slice(isvcNodes, func(i, j int) bool { return isvcNodes[i].Name < isvcNodes[j].Name })
+	isvc := inner.MakeInnerService(svc, lb.clusterID, lb.targetNamespace, isvcNodes)
+
+	cur, err := lb.getInnerService(ctx, svc)
+	switch {
+	case err != nil:
+		return nil, err
+	case cur == nil:
+		klog.V(1).Infof("creating new InnerService for %s/%s", svc.Namespace, svc.Name)
+		if err := inner.CreateInnerService(ctx, lb.outer, isvc, svc, isvcNodes); err != nil {
+			return nil, err
+		}
+		return isvc, nil
+	case cur.DeletionTimestamp != nil:
+		return nil, fmt.Errorf("InnerService %s/%s is being deleted", cur.Namespace, cur.Name)
+	}
+
+	if !reflect.DeepEqual(isvc.Spec, cur.Spec) {
+		klog.V(1).Infof("updating InnerService %s/%s", cur.Namespace, cur.Name)
+		cur.Spec = isvc.Spec
+		if err := lb.outer.Update(ctx, cur); err != nil {
+			return nil, err
+		}
+	}
+	if inner.SetNodesAvailableCondition(&cur.Status, svc, isvcNodes) {
+		klog.V(1).Infof("updating the conditions of InnerService %s/%s", cur.Namespace, cur.Name)
+		if err := lb.outer.Status().Update(ctx, cur); err != nil {
+			return nil, err
+		}
+	}
+	return cur, nil
+}
+
+// loadBalancerStatus returns the load balancer status for the inner
+// service. It fails if the service requested a specific IP but the
+// outer cluster assigned different address(es), so that the service
+// controller records an event for the service.
+func loadBalancerStatus(isvc *v1alpha1.InnerService) (*v1.LoadBalancerStatus, error) {
+	lbStatus := isvc.Status.LoadBalancer.DeepCopy()
+	requestedIP := isvc.Spec.LoadBalancerIP
+	if requestedIP == "" {
+		return lbStatus, nil
+	}
+	var assigned []string
+	for _, ingress := range lbStatus.Ingress {
+		if ingress.IP == requestedIP {
+			return lbStatus, nil
+		}
+		if ingress.IP != "" {
+			assigned = append(assigned, ingress.IP)
+		} else {
+			assigned = append(assigned, ingress.Hostname)
+		}
+	}
+	return nil, fmt.Errorf("requested load balancer IP %s, but the outer cluster assigned %s", requestedIP, strings.Join(assigned, ", "))
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/ivan4th/virtletlb/pkg/apis"
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+func newTestCloud(t *testing.T, outerObjs, innerObjs []runtime.Object) *cloud {
+	if err := apis.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("error adding APIs to the scheme: %v", err)
+	}
+	return &cloud{
+		outer:           fake.NewFakeClient(outerObjs...),
+		inner:           fake.NewFakeClient(innerObjs...),
+		targetNamespace: "outer",
+		clusterID:       "k8s",
+	}
+}
+
+func lbService(name string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{
+				{
+					Protocol: v1.ProtocolTCP,
+					Port:     80,
+					NodePort: 30080,
+				},
+			},
+		},
+	}
+}
+
+func readyNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{
+				{
+					Type:   v1.NodeReady,
+					Status: v1.ConditionTrue,
+				},
+			},
+		},
+	}
+}
+
+func getInnerService(t *testing.T, c *cloud, name string) *v1alpha1.InnerService {
+	isvc := &v1alpha1.InnerService{}
+	if err := c.outer.Get(context.TODO(), types.NamespacedName{Namespace: "outer", Name: name}, isvc); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		t.Fatalf("error getting InnerService %q: %v", name, err)
+	}
+	return isvc
+}
+
+// assignAddress does what the outer controller does when the outer
+// load balancer assigns the address
+func assignAddress(t *testing.T, c *cloud, name, ip string) {
+	isvc := getInnerService(t, c, name)
+	isvc.Status.ObservedGeneration = isvc.Generation
+	isvc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ip}}
+	if err := c.outer.Status().Update(context.TODO(), isvc); err != nil {
+		t.Fatalf("error updating InnerService %q: %v", name, err)
+	}
+}
+
+func TestLoadBalancer(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	c := newTestCloud(t, nil, nil)
+	lb, _ := c.LoadBalancer()
+	ctx := context.TODO()
+	svc := lbService("foo")
+	unschedulable := readyNode("k8s-2")
+	unschedulable.Spec.Unschedulable = true
+	nodes := []*v1.Node{readyNode("k8s-1"), readyNode("k8s-0"), unschedulable}
+
+	g.Expect(lb.GetLoadBalancerName(ctx, "kubernetes", svc)).To(gomega.Equal("k8s-default-foo"))
+	_, exists, err := lb.GetLoadBalancer(ctx, "kubernetes", svc)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(exists).To(gomega.BeFalse())
+
+	// the InnerService is created, but there's no address yet
+	_, err = lb.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes)
+	g.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("waiting for the outer service")))
+	isvc := getInnerService(t, c, "k8s-default-foo")
+	g.Expect(isvc).NotTo(gomega.BeNil())
+	g.Expect(isvc.Labels[v1alpha1.ClusterLabel]).To(gomega.Equal("k8s"))
+	g.Expect(isvc.Spec.NodeNames).To(gomega.Equal([]string{"k8s-0", "k8s-1"}))
+	g.Expect(isvc.Status.GetCondition(v1alpha1.InnerServiceNodesAvailable).Status).To(gomega.Equal(v1.ConditionTrue))
+
+	assignAddress(t, c, "k8s-default-foo", "10.0.0.1")
+	status, err := lb.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(status.Ingress).To(gomega.Equal([]v1.LoadBalancerIngress{{IP: "10.0.0.1"}}))
+	_, exists, err = lb.GetLoadBalancer(ctx, "kubernetes", svc)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(exists).To(gomega.BeTrue())
+
+	// the node changes are propagated to the InnerService
+	g.Expect(lb.UpdateLoadBalancer(ctx, "kubernetes", svc, nodes[:1])).To(gomega.Succeed())
+	g.Expect(getInnerService(t, c, "k8s-default-foo").Spec.NodeNames).To(gomega.Equal([]string{"k8s-1"}))
+	g.Expect(lb.UpdateLoadBalancer(ctx, "kubernetes", svc, nil)).To(gomega.Succeed())
+	isvc = getInnerService(t, c, "k8s-default-foo")
+	g.Expect(isvc.Spec.NodeNames).To(gomega.BeEmpty())
+	g.Expect(isvc.Status.GetCondition(v1alpha1.InnerServiceNodesAvailable).Status).To(gomega.Equal(v1.ConditionFalse))
+
+	// the InnerService is deleted, and the service controller
+	// waits till it's gone
+	g.Expect(lb.EnsureLoadBalancerDeleted(ctx, "kubernetes", svc)).To(gomega.MatchError(gomega.ContainSubstring("waiting for InnerService")))
+	g.Expect(getInnerService(t, c, "k8s-default-foo")).To(gomega.BeNil())
+	g.Expect(lb.EnsureLoadBalancerDeleted(ctx, "kubernetes", svc)).To(gomega.Succeed())
+}
+
+func TestLoadBalancerRequestedIP(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	c := newTestCloud(t, nil, nil)
+	lb, _ := c.LoadBalancer()
+	ctx := context.TODO()
+	svc := lbService("foo")
+	svc.Spec.LoadBalancerIP = "10.0.0.5"
+	nodes := []*v1.Node{readyNode("k8s-0")}
+
+	_, err := lb.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(getInnerService(t, c, "k8s-default-foo").Spec.LoadBalancerIP).To(gomega.Equal("10.0.0.5"))
+
+	assignAddress(t, c, "k8s-default-foo", "10.0.0.1")
+	_, err = lb.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes)
+	g.Expect(err).To(gomega.MatchError("requested load balancer IP 10.0.0.5, but the outer cluster assigned 10.0.0.1"))
+
+	assignAddress(t, c, "k8s-default-foo", "10.0.0.5")
+	status, err := lb.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(status.Ingress).To(gomega.Equal([]v1.LoadBalancerIngress{{IP: "10.0.0.5"}}))
+}
+
+func TestLoadBalancerDeletion(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	now := metav1.Now()
+	deleting := &v1alpha1.InnerService{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "outer",
+			Name:              "k8s-default-foo",
+			Labels:            map[string]string{v1alpha1.ClusterLabel: "k8s"},
+			DeletionTimestamp: &now,
+			Finalizers:        []string{"virtletlb.virtlet.cloud/outer-controller"},
+		},
+		Spec: v1alpha1.InnerServiceSpec{
+			ClusterID:        "k8s",
+			ServiceNamespace: "default",
+			ServiceName:      "foo",
+		},
+	}
+	foreign := deleting.DeepCopy()
+	foreign.Name = "k8s-default-bar"
+	foreign.DeletionTimestamp = nil
+	foreign.Labels[v1alpha1.ClusterLabel] = "other"
+	foreign.Spec.ClusterID = "other"
+	c := newTestCloud(t, []runtime.Object{deleting, foreign}, nil)
+	lb, _ := c.LoadBalancer()
+	ctx := context.TODO()
+
+	// the InnerService is still being finalized by the outer
+	// controller, so it's neither updated nor reported as deleted
+	svc := lbService("foo")
+	g.Expect(lb.EnsureLoadBalancerDeleted(ctx, "kubernetes", svc)).To(gomega.MatchError(gomega.ContainSubstring("waiting for InnerService")))
+	g.Expect(getInnerService(t, c, "k8s-default-foo")).NotTo(gomega.BeNil())
+	_, err := lb.EnsureLoadBalancer(ctx, "kubernetes", svc, []*v1.Node{readyNode("k8s-0")})
+	g.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("is being deleted")))
+
+	// the InnerServices of the other clusters are never touched
+	other := lbService("bar")
+	g.Expect(lb.EnsureLoadBalancerDeleted(ctx, "kubernetes", other)).To(gomega.HaveOccurred())
+	_, err = lb.EnsureLoadBalancer(ctx, "kubernetes", other, nil)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(getInnerService(t, c, "k8s-default-bar").Spec.ClusterID).To(gomega.Equal("other"))
+}
+
+func TestSweep(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	isvc := func(clusterID, svcName string) *v1alpha1.InnerService {
+		return &v1alpha1.InnerService{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "outer",
+				Name:      clusterID + "-default-" + svcName,
+				Labels:    map[string]string{v1alpha1.ClusterLabel: clusterID},
+			},
+			Spec: v1alpha1.InnerServiceSpec{
+				ClusterID:        clusterID,
+				ServiceNamespace: "default",
+				ServiceName:      svcName,
+			},
+		}
+	}
+	notLB := lbService("not-lb")
+	notLB.Spec.Type = v1.ServiceTypeClusterIP
+	c := newTestCloud(t,
+		[]runtime.Object{
+			isvc("k8s", "kept"),
+			isvc("k8s", "not-lb"),
+			isvc("k8s", "gone"),
+			isvc("other", "gone"),
+		},
+		[]runtime.Object{lbService("kept"), notLB})
+
+	g.Expect(c.sweep(sweeper.New("ccm", sweeper.Options{}, c.sweep))).To(gomega.Succeed())
+	g.Expect(getInnerService(t, c, "k8s-default-kept")).NotTo(gomega.BeNil())
+	g.Expect(getInnerService(t, c, "k8s-default-not-lb")).To(gomega.BeNil())
+	g.Expect(getInnerService(t, c, "k8s-default-gone")).To(gomega.BeNil())
+	g.Expect(getInnerService(t, c, "other-default-gone")).NotTo(gomega.BeNil())
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/controller/inner"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+// newSweeper returns a Sweeper that deletes the InnerServices of the
+// cluster which have no corresponding inner LoadBalancer services.
+// The service controller only deletes the InnerServices of the
+// services it sees going away, so the ones deleted while
+// cloud-controller-manager was down would be left behind otherwise.
+// The missing InnerServices are not resynced, as the service
+// controller syncs all of the services at startup anyway.
+func (c *cloud) newSweeper() *sweeper.Sweeper {
+	return sweeper.New("ccm", c.sweepOpts, c.sweep)
+}
+
+func (c *cloud) sweep(s *sweeper.Sweeper) error {
+	// the InnerServices go first, see the sweeper package doc
+	var isvcs v1alpha1.InnerServiceList
+	listOpts := client.InNamespace(c.targetNamespace).MatchingLabels(map[string]string{
+		v1alpha1.ClusterLabel: c.clusterID,
+	})
+	if err := c.outer.List(context.TODO(), listOpts, &isvcs); err != nil {
+		return fmt.Errorf("error listing InnerServices: %v", err)
+	}
+
+	var svcs v1.ServiceList
+	if err := c.inner.List(context.TODO(), &client.ListOptions{}, &svcs); err != nil {
+		return fmt.Errorf("error listing services: %v", err)
+	}
+
+	wanted := make(map[types.NamespacedName]bool)
+	for _, svc := range svcs.Items {
+		if svc.Spec.Type == v1.ServiceTypeLoadBalancer && svc.DeletionTimestamp == nil {
+			wanted[types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}] = true
+		}
+	}
+
+	for n := range isvcs.Items {
+		isvc := &isvcs.Items[n]
+		svcName := types.NamespacedName{
+			Namespace: isvc.Spec.ServiceNamespace,
+			Name:      isvc.Spec.ServiceName,
+		}
+		if wanted[svcName] && inner.OwnInnerService(isvc, c.clusterID, svcName) &&
+			inner.TargetNamespacedName(c.clusterID, c.targetNamespace, svcName).Name == isvc.Name {
+			continue
+		}
+		if isvc.DeletionTimestamp != nil {
+			// already being deleted
+			continue
+		}
+		if err := s.Delete("InnerService", isvc.Namespace+"/"+isvc.Name, func() error {
+			return c.outer.Delete(context.TODO(), isvc)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/locator"
+)
+
+const (
+	zoneLabel       = "topology.kubernetes.io/zone"
+	regionLabel     = "topology.kubernetes.io/region"
+	betaZoneLabel   = "failure-domain.beta.kubernetes.io/zone"
+	betaRegionLabel = "failure-domain.beta.kubernetes.io/region"
+
+	// zoneSyncInterval specifies how often the zone labels of the
+	// inner nodes are checked against the outer nodes of their
+	// VM pods
+	zoneSyncInterval = time.Minute
+)
+
+// zones implements cloudprovider.Zones. The zone and the region of
+// an inner node are taken from the outer node that hosts its VM pod.
+type zones struct {
+	*cloud
+}
+
+// GetZone implements GetZone method of cloudprovider.Zones. It's
+// only used by the kubelets that run the cloud provider in-tree,
+// which is not supported.
+func (z *zones) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
+	return cloudprovider.Zone{}, cloudprovider.NotImplemented
+}
+
+// GetZoneByProviderID implements GetZoneByProviderID method of cloudprovider.Zones
+func (z *zones) GetZoneByProviderID(ctx context.Context, providerID string) (cloudprovider.Zone, error) {
+	pod, err := z.podByProviderID(providerID)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return z.podZone(ctx, pod)
+}
+
+// GetZoneByNodeName implements GetZoneByNodeName method of cloudprovider.Zones
+func (z *zones) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
+	pod, err := z.pod(string(nodeName))
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return z.podZone(ctx, pod)
+}
+
+// podZone returns the zone of the outer node that hosts the pod
+func (c *cloud) podZone(ctx context.Context, pod *v1.Pod) (cloudprovider.Zone, error) {
+	if pod.Spec.NodeName == "" {
+		return cloudprovider.Zone{}, fmt.Errorf("pod %s/%s is not scheduled yet", pod.Namespace, pod.Name)
+	}
+	node := &v1.Node{}
+	if err := c.outer.Get(ctx, types.NamespacedName{Name: pod.Spec.NodeName}, node); err != nil {
+		return cloudprovider.Zone{}, fmt.Errorf("error getting outer node %q: %v", pod.Spec.NodeName, err)
+	}
+	return cloudprovider.Zone{
+		FailureDomain: labelValue(node, zoneLabel, betaZoneLabel),
+		Region:        labelValue(node, regionLabel, betaRegionLabel),
+	}, nil
+}
+
+// labelValue returns the value of the first of the node labels
+// that is set
+func labelValue(node *v1.Node, keys ...string) string {
+	for _, k := range keys {
+		if v := node.Labels[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// syncZones updates the zone labels of the inner nodes. The cloud
+// node controller only sets them when the nodes are initialized, so
+// they would become stale when the VMs are rescheduled to other
+// outer nodes. The outer pods are listed once per sync rather than
+// looked up for every inner node, as the lookup lists the pods for
+// most of the backends.
+func (c *cloud) syncZones() {
+	var nodes v1.NodeList
+	if err := c.inner.List(context.TODO(), &client.ListOptions{}, &nodes); err != nil {
+		klog.Warningf("error listing inner nodes: %v", err)
+		return
+	}
+	pods, err := c.backendPods()
+	if err != nil {
+		klog.Warningf("%v", err)
+		return
+	}
+	// zones maps the outer node names to their zones
+	zones := make(map[string]cloudprovider.Zone)
+	for n := range nodes.Items {
+		if err := c.syncNodeZone(&nodes.Items[n], pods, zones); err != nil {
+			klog.Warningf("error syncing the zone of node %q: %v", nodes.Items[n].Name, err)
+		}
+	}
+}
+
+// backendPods returns the outer pods of the backends keyed by the
+// backend names
+func (c *cloud) backendPods() (map[string]*v1.Pod, error) {
+	var pods v1.PodList
+	if err := c.outer.List(context.TODO(), client.InNamespace(c.targetNamespace), &pods); err != nil {
+		return nil, fmt.Errorf("error listing outer pods: %v", err)
+	}
+	r := make(map[string]*v1.Pod)
+	for n := range pods.Items {
+		pod := &pods.Items[n]
+		name := c.backend.Name(pod)
+		if name != "" && (r[name] == nil || locator.PreferPod(pod, r[name])) {
+			r[name] = pod
+		}
+	}
+	return r, nil
+}
+
+func (c *cloud) syncNodeZone(node *v1.Node, pods map[string]*v1.Pod, zones map[string]cloudprovider.Zone) error {
+	name := node.Name
+	if node.Spec.ProviderID != "" {
+		name = locator.ParseProviderID(node.Spec.ProviderID, c.targetNamespace)
+		if name == "" {
+			return fmt.Errorf("provider ID %q doesn't refer to the namespace %q", node.Spec.ProviderID, c.targetNamespace)
+		}
+	}
+	pod := pods[name]
+	if pod == nil {
+		return cloudprovider.InstanceNotFound
+	}
+	zone, found := zones[pod.Spec.NodeName]
+	if !found {
+		var err error
+		if zone, err = c.podZone(context.TODO(), pod); err != nil {
+			return err
+		}
+		zones[pod.Spec.NodeName] = zone
+	}
+
+	if !setZoneLabels(node, zone) {
+		return nil
+	}
+	klog.V(1).Infof("updating zone labels of node %q: zone %q, region %q", node.Name, zone.FailureDomain, zone.Region)
+	return c.inner.Update(context.TODO(), node)
+}
+
+// setZoneLabels sets the zone and region labels of the node, both
+// GA and beta ones. The empty values are skipped. It returns true
+// if any of the labels has changed.
+func setZoneLabels(node *v1.Node, zone cloudprovider.Zone) bool {
+	changed := false
+	for _, l := range []struct {
+		keys  []string
+		value string
+	}{
+		{[]string{zoneLabel, betaZoneLabel}, zone.FailureDomain},
+		{[]string{regionLabel, betaRegionLabel}, zone.Region},
+	} {
+		if l.value == "" {
+			continue
+		}
+		for _, k := range l.keys {
+			if node.Labels[k] != l.value {
+				if node.Labels == nil {
+					node.Labels = make(map[string]string)
+				}
+				node.Labels[k] = l.value
+				changed = true
+			}
+		}
+	}
+	return changed
+}
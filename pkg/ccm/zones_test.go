@@ -0,0 +1,148 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ccm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/locator"
+)
+
+// listCountingClient counts the List calls
+type listCountingClient struct {
+	client.Client
+	lists int
+}
+
+func (c *listCountingClient) List(ctx context.Context, opts *client.ListOptions, list runtime.Object) error {
+	c.lists++
+	return c.Client.List(ctx, opts, list)
+}
+
+func node(name string, labels map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
+
+func vmPod(name, nodeName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "outer",
+			Name:      name,
+		},
+		Spec: v1.PodSpec{NodeName: nodeName},
+	}
+}
+
+func TestSyncZones(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	c := newTestCloud(t,
+		[]runtime.Object{
+			node("node-a", map[string]string{
+				zoneLabel:       "zone-a",
+				regionLabel:     "region-1",
+				betaZoneLabel:   "old-zone-a",
+				betaRegionLabel: "old-region-1",
+			}),
+			// only the beta labels are set
+			node("node-b", map[string]string{
+				betaZoneLabel:   "zone-b",
+				betaRegionLabel: "region-1",
+			}),
+			node("node-c", nil),
+			vmPod("k8s-0", "node-a"),
+			vmPod("k8s-1", "node-b"),
+			vmPod("k8s-2", "node-c"),
+			vmPod("k8s-3", ""),
+		},
+		[]runtime.Object{
+			node("k8s-0", nil),
+			// the VM has moved to another outer node
+			&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "renamed",
+					Labels: map[string]string{
+						zoneLabel:       "zone-a",
+						betaZoneLabel:   "zone-a",
+						regionLabel:     "region-1",
+						betaRegionLabel: "region-1",
+					},
+				},
+				Spec: v1.NodeSpec{ProviderID: "virtletlb://outer/k8s-1"},
+			},
+			// the outer node has no zone
+			node("k8s-2", map[string]string{zoneLabel: "zone-x"}),
+			// the VM pod is not scheduled
+			node("k8s-3", nil),
+			// there's no VM pod
+			node("k8s-5", nil),
+		})
+	outer := &listCountingClient{Client: c.outer}
+	c.outer = outer
+	c.backend, _ = locator.NewBackend(locator.StatefulSetBackend, outer, "outer", "")
+
+	c.syncZones()
+	g.Expect(outer.lists).To(gomega.Equal(1))
+
+	for name, expected := range map[string]map[string]string{
+		"k8s-0": {
+			zoneLabel:       "zone-a",
+			betaZoneLabel:   "zone-a",
+			regionLabel:     "region-1",
+			betaRegionLabel: "region-1",
+		},
+		"renamed": {
+			zoneLabel:       "zone-b",
+			betaZoneLabel:   "zone-b",
+			regionLabel:     "region-1",
+			betaRegionLabel: "region-1",
+		},
+		"k8s-2": {zoneLabel: "zone-x"},
+		"k8s-3": nil,
+		"k8s-5": nil,
+	} {
+		n := &v1.Node{}
+		g.Expect(c.inner.Get(context.TODO(), types.NamespacedName{Name: name}, n)).To(gomega.Succeed())
+		g.Expect(n.Labels).To(gomega.Equal(expected), "node %q", name)
+	}
+}
+
+func TestSetZoneLabels(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	n := node("k8s-0", nil)
+	g.Expect(setZoneLabels(n, cloudprovider.Zone{FailureDomain: "zone-a"})).To(gomega.BeTrue())
+	g.Expect(n.Labels).To(gomega.Equal(map[string]string{
+		zoneLabel:     "zone-a",
+		betaZoneLabel: "zone-a",
+	}))
+	g.Expect(setZoneLabels(n, cloudprovider.Zone{FailureDomain: "zone-a"})).To(gomega.BeFalse())
+	g.Expect(setZoneLabels(n, cloudprovider.Zone{FailureDomain: "zone-a", Region: "region-1"})).To(gomega.BeTrue())
+	g.Expect(n.Labels).To(gomega.HaveLen(4))
+}
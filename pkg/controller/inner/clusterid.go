@@ -0,0 +1,82 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/names"
+)
+
+// maxClusterIDLength is the maximum length of the cluster ID. The ID
+// and the dash after it must fit into the part of the object names
+// that's kept by names.Shorten, including the InnerIngress names that
+// have a suffix of their own.
+const maxClusterIDLength = names.MaxLength - ingressSuffixLength - names.HashLength - 2
+
+var statefulSetPodNameRx = regexp.MustCompile(`^(.*)-\d+$`)
+
+// DetectClusterID derives the ID of the inner cluster from the
+// names of its nodes. The nodes are VM pods of the same StatefulSet
+// in the outer cluster, so they're named <statefulset>-<ordinal>,
+// and the StatefulSet name is unique within the outer namespace.
+func DetectClusterID(c client.Client) (string, error) {
+	var nodes v1.NodeList
+	if err := c.List(context.TODO(), &client.ListOptions{}, &nodes); err != nil {
+		return "", fmt.Errorf("error listing nodes: %v", err)
+	}
+
+	clusterID := ""
+	for _, node := range nodes.Items {
+		m := statefulSetPodNameRx.FindStringSubmatch(node.Name)
+		if m == nil {
+			return "", fmt.Errorf("node name %q doesn't look like a StatefulSet pod name", node.Name)
+		}
+		if clusterID != "" && clusterID != m[1] {
+			return "", fmt.Errorf("nodes belong to different StatefulSets: %q and %q", clusterID, m[1])
+		}
+		clusterID = m[1]
+	}
+	if clusterID == "" {
+		return "", fmt.Errorf("no nodes found")
+	}
+	if err := ValidateClusterID(clusterID); err != nil {
+		return "", err
+	}
+	return clusterID, nil
+}
+
+// ValidateClusterID verifies that the cluster ID can be used as
+// a part of object names and as a label value. The cluster ID
+// starts the names of the outer services, so it must be a DNS-1035
+// label.
+func ValidateClusterID(clusterID string) error {
+	if errs := validation.IsDNS1035Label(clusterID); len(errs) != 0 {
+		return fmt.Errorf("invalid cluster ID %q: %s", clusterID, strings.Join(errs, "; "))
+	}
+	if len(clusterID) > maxClusterIDLength {
+		return fmt.Errorf("invalid cluster ID %q: must be no more than %d characters", clusterID, maxClusterIDLength)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDetectClusterID(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		nodeNames []string
+		clusterID string
+	}{
+		{
+			name:      "statefulset",
+			nodeNames: []string{"k8s-0", "k8s-1", "k8s-2"},
+			clusterID: "k8s",
+		},
+		{
+			name:      "dashes in the statefulset name",
+			nodeNames: []string{"my-cluster-0", "my-cluster-10"},
+			clusterID: "my-cluster",
+		},
+		{
+			name:      "different statefulsets",
+			nodeNames: []string{"k8s-0", "other-1"},
+		},
+		{
+			name:      "not a statefulset pod",
+			nodeNames: []string{"node"},
+		},
+		{
+			name:      "invalid cluster ID",
+			nodeNames: []string{"1cluster-0"},
+		},
+		{
+			name: "no nodes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var objs []runtime.Object
+			for _, name := range tc.nodeNames {
+				objs = append(objs, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			}
+			clusterID, err := DetectClusterID(fake.NewFakeClient(objs...))
+			switch {
+			case tc.clusterID == "" && err == nil:
+				t.Errorf("DetectClusterID didn't fail, cluster ID %q", clusterID)
+			case tc.clusterID != "" && err != nil:
+				t.Errorf("DetectClusterID failed: %v", err)
+			case clusterID != tc.clusterID:
+				t.Errorf("bad cluster ID: %q instead of %q", clusterID, tc.clusterID)
+			}
+		})
+	}
+}
+
+func TestValidateClusterID(t *testing.T) {
+	for _, tc := range []struct {
+		clusterID string
+		valid     bool
+	}{
+		{"k8s", true},
+		{"my-cluster-1", true},
+		{strings.Repeat("a", maxClusterIDLength), true},
+		{strings.Repeat("a", maxClusterIDLength+1), false},
+		// the outer service names must be DNS-1035 labels
+		{"1cluster", false},
+		{"K8s", false},
+		{"k8s-", false},
+		{"k8s.local", false},
+		{"", false},
+	} {
+		err := ValidateClusterID(tc.clusterID)
+		if tc.valid && err != nil {
+			t.Errorf("cluster ID %q: unexpected error: %v", tc.clusterID, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("cluster ID %q: no error", tc.clusterID)
+		}
+	}
+}
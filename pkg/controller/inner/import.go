@@ -0,0 +1,394 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"admiralty.io/multicluster-controller/pkg/cluster"
+	"admiralty.io/multicluster-controller/pkg/controller"
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/handler"
+)
+
+const (
+	// importAnnotation opts an outer service in for the import
+	// into the inner cluster. Its value is the import mode.
+	importAnnotation = "virtletlb.virtlet.cloud/import"
+	// importNamespaceAnnotation specifies the inner namespace of
+	// the imported service
+	importNamespaceAnnotation = "virtletlb.virtlet.cloud/import-namespace"
+	// importedFromLabel is set on the inner Services and Endpoints
+	// made for the outer services. Its value is the name of the
+	// outer service.
+	importedFromLabel = "virtletlb.virtlet.cloud/imported-from"
+	// outerNamespaceAnnotation holds the namespace of the outer
+	// service on the imported service
+	outerNamespaceAnnotation = "virtletlb.virtlet.cloud/outer-namespace"
+
+	// ImportClusterIP makes the Endpoints of the imported service
+	// point to the ClusterIP of the outer service
+	ImportClusterIP = "cluster-ip"
+	// ImportEndpoints makes the Endpoints of the imported service
+	// mirror the ones of the outer service, i.e. point to the
+	// outer pod IPs
+	ImportEndpoints = "endpoints"
+)
+
+// ImportOptions specifies the options of the import controller
+type ImportOptions struct {
+	// Namespace is the default inner namespace of the imported
+	// services
+	Namespace string
+}
+
+// NewImportController returns a controller that imports the outer
+// services of the target namespace of the outer cluster that have
+// virtletlb.virtlet.cloud/import annotation into the inner cluster.
+// The imported services have no selectors, their Endpoints point to
+// the outer ClusterIPs or pod IPs which must be routable from the VMs.
+func NewImportController(outer *cluster.Cluster, inner *cluster.Cluster, targetNamespace string, opts ImportOptions) (*controller.Controller, error) {
+	klog.V(1).Infof("*** starting import watch (targetNamespace: %v) ***", targetNamespace)
+	outerclient, err := outer.GetDelegatingClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting delegating client for outer cluster: %v", err)
+	}
+	innerclient, err := inner.GetDelegatingClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting delegating client for inner cluster: %v", err)
+	}
+
+	r := &importReconciler{
+		outer:            outerclient,
+		inner:            innerclient,
+		outerName:        outer.GetClusterName(),
+		targetNamespace:  targetNamespace,
+		defaultNamespace: opts.Namespace,
+	}
+	co := controller.New(r, controller.Options{})
+
+	if err := co.WatchResourceReconcileObject(outer, &v1.Service{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up Service watch in outer cluster: %v", err)
+	}
+	if err := co.WatchResourceReconcileObject(outer, &v1.Endpoints{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up Endpoints watch in outer cluster: %v", err)
+	}
+	// the imported objects that are changed or deleted in the
+	// inner cluster are restored
+	for _, obj := range []runtime.Object{&v1.Service{}, &v1.Endpoints{}} {
+		if err := inner.AddEventHandler(obj, &handler.EnqueueRequestsFromMapFunc{
+			Queue:      co.Queue,
+			ToRequests: r.outerServiceForObject,
+		}); err != nil {
+			return nil, fmt.Errorf("setting up %T watch in inner cluster: %v", obj, err)
+		}
+	}
+	klog.V(1).Infof("*** import watch started ***")
+
+	return co, nil
+}
+
+type importReconciler struct {
+	outer            client.Client
+	inner            client.Client
+	outerName        string
+	targetNamespace  string
+	defaultNamespace string
+}
+
+func (r *importReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	if req.Namespace != r.targetNamespace {
+		return reconcile.Result{}, nil
+	}
+	reqName := req.NamespacedName.String()
+	klog.V(1).Infof("*** import watch: %v ***", reqName)
+
+	svc := &v1.Service{}
+	if err := r.outer.Get(context.TODO(), req.NamespacedName, svc); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("no outer service %v; deleting the imported service, if it exists", reqName)
+			return reconcile.Result{}, r.deleteImported(req.Name, "")
+		}
+		return reconcile.Result{}, err
+	}
+	if !r.imported(svc) {
+		return reconcile.Result{}, r.deleteImported(req.Name, "")
+	}
+
+	ep := &v1.Endpoints{}
+	if err := r.outer.Get(context.TODO(), req.NamespacedName, ep); err != nil {
+		if !errors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+		ep = nil
+	}
+
+	importedSvc := r.makeImportedService(svc)
+	// the service may have been moved to another inner namespace
+	if err := r.deleteImported(req.Name, importedSvc.Namespace); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.syncImportedService(importedSvc); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, r.syncImportedEndpoints(r.makeImportedEndpoints(importedSvc, svc, ep))
+}
+
+// imported returns true if the outer service must be imported into
+// the inner cluster
+func (r *importReconciler) imported(svc *v1.Service) bool {
+	if svc.DeletionTimestamp != nil {
+		return false
+	}
+	switch mode := svc.Annotations[importAnnotation]; mode {
+	case "":
+		return false
+	case ImportClusterIP, ImportEndpoints:
+		return true
+	default:
+		klog.Warningf("bad import mode %q of the outer service %s/%s", mode, svc.Namespace, svc.Name)
+		return false
+	}
+}
+
+// importedNamespace returns the inner namespace of the imported
+// service for the outer service
+func (r *importReconciler) importedNamespace(svc *v1.Service) string {
+	if ns := svc.Annotations[importNamespaceAnnotation]; ns != "" {
+		return ns
+	}
+	return r.defaultNamespace
+}
+
+// makeImportedService makes a selectorless inner service for the
+// outer service
+func (r *importReconciler) makeImportedService(svc *v1.Service) *v1.Service {
+	var ports []v1.ServicePort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1.ServicePort{
+			Name:     p.Name,
+			Protocol: p.Protocol,
+			Port:     p.Port,
+			// same as the apiserver default, which avoids
+			// unneeded updates
+			TargetPort: intstr.FromInt(int(p.Port)),
+		})
+	}
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.importedNamespace(svc),
+			Name:      svc.Name,
+			Labels: map[string]string{
+				importedFromLabel: svc.Name,
+			},
+			Annotations: map[string]string{
+				outerNamespaceAnnotation: svc.Namespace,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:            v1.ServiceTypeClusterIP,
+			Ports:           ports,
+			SessionAffinity: v1.ServiceAffinityNone,
+		},
+	}
+}
+
+// makeImportedEndpoints makes the Endpoints of the imported service.
+// They point either to the ClusterIP of the outer service or to the
+// addresses of its Endpoints. Headless outer services always use
+// the latter. ep may be nil if the outer service has no Endpoints.
+func (r *importReconciler) makeImportedEndpoints(importedSvc, svc *v1.Service, ep *v1.Endpoints) *v1.Endpoints {
+	importedEp := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   importedSvc.Namespace,
+			Name:        importedSvc.Name,
+			Labels:      importedSvc.Labels,
+			Annotations: importedSvc.Annotations,
+		},
+	}
+
+	clusterIP := svc.Spec.ClusterIP
+	if svc.Annotations[importAnnotation] == ImportClusterIP && clusterIP != "" && clusterIP != v1.ClusterIPNone {
+		var ports []v1.EndpointPort
+		for _, p := range svc.Spec.Ports {
+			ports = append(ports, v1.EndpointPort{
+				Name:     p.Name,
+				Protocol: p.Protocol,
+				Port:     p.Port,
+			})
+		}
+		if len(ports) > 0 {
+			importedEp.Subsets = []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: clusterIP}},
+					Ports:     ports,
+				},
+			}
+		}
+		return importedEp
+	}
+
+	if ep == nil {
+		return importedEp
+	}
+	for _, subset := range ep.Subsets {
+		importedEp.Subsets = append(importedEp.Subsets, v1.EndpointSubset{
+			Addresses:         importedAddresses(subset.Addresses),
+			NotReadyAddresses: importedAddresses(subset.NotReadyAddresses),
+			Ports:             subset.Ports,
+		})
+	}
+	return importedEp
+}
+
+// importedAddresses returns the copies of the outer endpoint addresses
+// without the references to the outer pods and nodes
+func importedAddresses(addrs []v1.EndpointAddress) []v1.EndpointAddress {
+	var r []v1.EndpointAddress
+	for _, addr := range addrs {
+		r = append(r, v1.EndpointAddress{
+			IP:       addr.IP,
+			Hostname: addr.Hostname,
+		})
+	}
+	return r
+}
+
+// ownImported returns true if the inner object was made for the
+// outer service with the specified name
+func ownImported(obj metav1.Object, name string) bool {
+	value, found := obj.GetLabels()[importedFromLabel]
+	return found && value == name
+}
+
+// syncImportedService creates the imported service or updates the
+// existing one if it doesn't match
+func (r *importReconciler) syncImportedService(svc *v1.Service) error {
+	cur := &v1.Service{}
+	if err := r.inner.Get(context.TODO(), types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}, cur); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("creating imported service %s/%s", svc.Namespace, svc.Name)
+			return r.inner.Create(context.TODO(), svc)
+		}
+		return err
+	}
+	if !ownImported(cur, svc.Name) {
+		klog.Warningf("service %s/%s already exists and isn't imported from the outer cluster, not touching it", cur.Namespace, cur.Name)
+		return nil
+	}
+	if reflect.DeepEqual(cur.Spec.Ports, svc.Spec.Ports) && len(cur.Spec.Selector) == 0 &&
+		cur.Annotations[outerNamespaceAnnotation] == svc.Annotations[outerNamespaceAnnotation] {
+		return nil
+	}
+	klog.V(1).Infof("updating imported service %s/%s", svc.Namespace, svc.Name)
+	cur.Spec.Ports = svc.Spec.Ports
+	cur.Spec.Selector = nil
+	if cur.Annotations == nil {
+		cur.Annotations = make(map[string]string)
+	}
+	cur.Annotations[outerNamespaceAnnotation] = svc.Annotations[outerNamespaceAnnotation]
+	return r.inner.Update(context.TODO(), cur)
+}
+
+// syncImportedEndpoints creates the Endpoints of the imported service
+// or updates the existing ones if their subsets don't match
+func (r *importReconciler) syncImportedEndpoints(ep *v1.Endpoints) error {
+	cur := &v1.Endpoints{}
+	if err := r.inner.Get(context.TODO(), types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}, cur); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("creating imported endpoints %s/%s", ep.Namespace, ep.Name)
+			return r.inner.Create(context.TODO(), ep)
+		}
+		return err
+	}
+	if !ownImported(cur, ep.Name) {
+		// the service is not ours either, see syncImportedService
+		return nil
+	}
+	if reflect.DeepEqual(cur.Subsets, ep.Subsets) {
+		return nil
+	}
+	klog.V(1).Infof("imported endpoints mismatch! WAS:\n%s\n\nNOW:\n%s\n", ToJSON(cur.Subsets), ToJSON(ep.Subsets))
+	cur.Subsets = ep.Subsets
+	return r.inner.Update(context.TODO(), cur)
+}
+
+// deleteImported deletes the inner Services and Endpoints imported
+// from the outer service with the specified name, except for the
+// ones in keepNamespace
+func (r *importReconciler) deleteImported(name, keepNamespace string) error {
+	listOpts := client.MatchingLabels(map[string]string{importedFromLabel: name})
+	var svcs v1.ServiceList
+	if err := r.inner.List(context.TODO(), listOpts, &svcs); err != nil {
+		return err
+	}
+	var eps v1.EndpointsList
+	if err := r.inner.List(context.TODO(), listOpts, &eps); err != nil {
+		return err
+	}
+	var objs []runtime.Object
+	for n := range svcs.Items {
+		if svcs.Items[n].Namespace != keepNamespace {
+			objs = append(objs, &svcs.Items[n])
+		}
+	}
+	for n := range eps.Items {
+		if eps.Items[n].Namespace != keepNamespace {
+			objs = append(objs, &eps.Items[n])
+		}
+	}
+	for _, obj := range objs {
+		klog.V(1).Infof("deleting imported %T for the outer service %s", obj, name)
+		if err := r.inner.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// outerServiceForObject maps the imported inner Services and
+// Endpoints to the outer services
+func (r *importReconciler) outerServiceForObject(obj interface{}) []reconcile.Request {
+	o, ok := obj.(metav1.Object)
+	if !ok {
+		return nil
+	}
+	name, found := o.GetLabels()[importedFromLabel]
+	if !found {
+		return nil
+	}
+	return []reconcile.Request{
+		{
+			Context: r.outerName,
+			NamespacedName: types.NamespacedName{
+				Namespace: r.targetNamespace,
+				Name:      name,
+			},
+		},
+	}
+}
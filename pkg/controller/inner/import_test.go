@@ -0,0 +1,229 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+func newTestImportReconciler(outerObjs, innerObjs []runtime.Object) *importReconciler {
+	return &importReconciler{
+		outer:            fake.NewFakeClient(outerObjs...),
+		inner:            fake.NewFakeClient(innerObjs...),
+		outerName:        "outer",
+		targetNamespace:  "outer",
+		defaultNamespace: "default",
+	}
+}
+
+func outerService(name, mode, clusterIP string) *v1.Service {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "outer",
+			Name:      name,
+		},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: clusterIP,
+			Ports:     []v1.ServicePort{{Name: "db", Protocol: v1.ProtocolTCP, Port: 5432}},
+		},
+	}
+	if mode != "" {
+		svc.Annotations = map[string]string{importAnnotation: mode}
+	}
+	return svc
+}
+
+func importedService(namespace, name, from string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{importedFromLabel: from},
+		},
+	}
+}
+
+func TestMakeImportedEndpoints(t *testing.T) {
+	nodeName := "outer-node-1"
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "outer", Name: "db"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP:        "10.244.1.5",
+						Hostname:  "db-0",
+						NodeName:  &nodeName,
+						TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "outer", Name: "db-0"},
+					},
+				},
+				NotReadyAddresses: []v1.EndpointAddress{
+					{
+						IP:        "10.244.2.7",
+						TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "outer", Name: "db-1"},
+					},
+				},
+				Ports: []v1.EndpointPort{{Name: "db", Protocol: v1.ProtocolTCP, Port: 5432}},
+			},
+		},
+	}
+	// the references to the outer pods and nodes are dropped
+	podSubsets := []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.244.1.5", Hostname: "db-0"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.244.2.7"}},
+			Ports:             []v1.EndpointPort{{Name: "db", Protocol: v1.ProtocolTCP, Port: 5432}},
+		},
+	}
+	clusterIPSubsets := []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.96.0.42"}},
+			Ports:     []v1.EndpointPort{{Name: "db", Protocol: v1.ProtocolTCP, Port: 5432}},
+		},
+	}
+	for _, tc := range []struct {
+		name    string
+		svc     *v1.Service
+		ep      *v1.Endpoints
+		subsets []v1.EndpointSubset
+	}{
+		{
+			name:    "cluster-ip",
+			svc:     outerService("db", ImportClusterIP, "10.96.0.42"),
+			ep:      ep,
+			subsets: clusterIPSubsets,
+		},
+		{
+			name:    "endpoints",
+			svc:     outerService("db", ImportEndpoints, "10.96.0.42"),
+			ep:      ep,
+			subsets: podSubsets,
+		},
+		{
+			name:    "headless",
+			svc:     outerService("db", ImportClusterIP, v1.ClusterIPNone),
+			ep:      ep,
+			subsets: podSubsets,
+		},
+		{
+			name: "no endpoints",
+			svc:  outerService("db", ImportEndpoints, "10.96.0.42"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			r := newTestImportReconciler(nil, nil)
+			importedSvc := r.makeImportedService(tc.svc)
+			importedEp := r.makeImportedEndpoints(importedSvc, tc.svc, tc.ep)
+			g.Expect(importedEp.Namespace).To(gomega.Equal("default"))
+			g.Expect(importedEp.Name).To(gomega.Equal("db"))
+			g.Expect(importedEp.Labels).To(gomega.HaveKeyWithValue(importedFromLabel, "db"))
+			g.Expect(importedEp.Subsets).To(gomega.Equal(tc.subsets))
+		})
+	}
+}
+
+func TestImportDoesntTakeOverServices(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	// the inner service and its Endpoints have the same name as
+	// the imported one but weren't made by the controller
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeClusterIP,
+			Selector: map[string]string{"app": "db"},
+			Ports:    []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 3306}},
+		},
+	}
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.1.0.5"}},
+				Ports:     []v1.EndpointPort{{Protocol: v1.ProtocolTCP, Port: 3306}},
+			},
+		},
+	}
+	r := newTestImportReconciler(
+		[]runtime.Object{outerService("db", ImportClusterIP, "10.96.0.42")},
+		[]runtime.Object{svc.DeepCopy(), ep.DeepCopy()})
+	_, err := r.Reconcile(reconcile.Request{
+		Context:        "outer",
+		NamespacedName: types.NamespacedName{Namespace: "outer", Name: "db"},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	curSvc := &v1.Service{}
+	g.Expect(r.inner.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db"}, curSvc)).To(gomega.Succeed())
+	g.Expect(curSvc.Labels).NotTo(gomega.HaveKey(importedFromLabel))
+	g.Expect(curSvc.Spec).To(gomega.Equal(svc.Spec))
+	curEp := &v1.Endpoints{}
+	g.Expect(r.inner.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db"}, curEp)).To(gomega.Succeed())
+	g.Expect(curEp.Subsets).To(gomega.Equal(ep.Subsets))
+}
+
+func TestImportSweep(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	moved := outerService("moved", ImportEndpoints, "10.96.0.43")
+	moved.Annotations[importNamespaceAnnotation] = "db"
+	r := newTestImportReconciler([]runtime.Object{
+		outerService("db", ImportClusterIP, "10.96.0.42"),
+		moved,
+		outerService("missing", ImportClusterIP, "10.96.0.44"),
+		outerService("plain", "", "10.96.0.45"),
+	}, []runtime.Object{
+		importedService("default", "db", "db"),
+		// the service was moved to another inner namespace
+		importedService("default", "moved", "moved"),
+		// the service is no longer imported
+		importedService("default", "plain", "plain"),
+		// the outer service is gone
+		importedService("default", "gone", "gone"),
+		// not imported
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "local"}},
+	})
+
+	var resynced []string
+	g.Expect(r.sweep(sweeper.New("import", sweeper.Options{}, nil), func(nsn types.NamespacedName) {
+		resynced = append(resynced, nsn.String())
+	})).To(gomega.Succeed())
+	sort.Strings(resynced)
+	g.Expect(resynced).To(gomega.Equal([]string{"outer/missing", "outer/moved"}))
+
+	var svcs v1.ServiceList
+	g.Expect(r.inner.List(context.TODO(), &client.ListOptions{}, &svcs)).To(gomega.Succeed())
+	var names []string
+	for _, svc := range svcs.Items {
+		names = append(names, svc.Namespace+"/"+svc.Name)
+	}
+	sort.Strings(names)
+	g.Expect(names).To(gomega.Equal([]string{"default/db", "default/local"}))
+}
@@ -0,0 +1,386 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"admiralty.io/multicluster-controller/pkg/cluster"
+	"admiralty.io/multicluster-controller/pkg/controller"
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"admiralty.io/multicluster-controller/pkg/reference"
+	"k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis"
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/finalizer"
+	"github.com/ivan4th/virtletlb/pkg/handler"
+	"github.com/ivan4th/virtletlb/pkg/names"
+)
+
+const (
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+	// ingressSuffixLength is the length of the suffix of the
+	// InnerIngress names, see ingressNamespacedName
+	ingressSuffixLength = len("-ingress-") + names.HashLength
+)
+
+// IngressOptions specifies the options of the inner ingress
+// controller
+type IngressOptions struct {
+	Options
+	// IngressService is the service of the inner ingress
+	// controller. Its node port receives the HTTP traffic of
+	// the outer ingress.
+	IngressService types.NamespacedName
+	// IngressPort is the name or the number of the HTTP port of
+	// the ingress controller's service
+	IngressPort string
+	// IngressClass specifies the kubernetes.io/ingress.class of
+	// the inner ingress controller. The inner Ingresses of the
+	// other classes are not mirrored. Empty value means that all
+	// of the Ingresses are mirrored.
+	IngressClass string
+}
+
+// NewIngressController returns a controller that makes InnerIngresses
+// in the target namespace of the dest cluster for the Ingresses of
+// the source cluster
+func NewIngressController(source *cluster.Cluster, dest *cluster.Cluster, targetNamespace string, opts IngressOptions) (*controller.Controller, error) {
+	klog.V(1).Infof("*** starting ingress watch (targetNamespace: %v, clusterID: %v) ***", targetNamespace, opts.ClusterID)
+	sourceclient, err := source.GetDelegatingClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting delegating client for source cluster: %v", err)
+	}
+	destclient, err := dest.GetDelegatingClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting delegating client for dest cluster: %v", err)
+	}
+
+	r := &ingressReconciler{
+		reconciler: &reconciler{
+			source:          sourceclient,
+			dest:            destclient,
+			sourceName:      source.GetClusterName(),
+			targetNamespace: targetNamespace,
+			clusterID:       opts.ClusterID,
+			podRefKey:       opts.PodRefKey,
+			recorder:        opts.Recorder,
+		},
+		ingressService: opts.IngressService,
+		ingressPort:    opts.IngressPort,
+		ingressClass:   opts.IngressClass,
+	}
+	co := controller.New(r, controller.Options{})
+
+	if err := co.WatchResourceReconcileObject(source, &extv1beta1.Ingress{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up Ingress watch in source cluster: %v", err)
+	}
+	// all the ingresses are served by the same ingress controller,
+	// so they're affected by the changes in its service, its
+	// endpoints and the nodes
+	for _, obj := range []runtime.Object{&v1.Service{}, &v1.Endpoints{}, &v1.Node{}} {
+		h := &handler.EnqueueRequestsFromMapFunc{
+			Queue:      co.Queue,
+			ToRequests: r.ingressesForObject,
+		}
+		if _, ok := obj.(*v1.Node); ok {
+			h.UpdateFilter = r.nodeChanged
+		}
+		if err := source.AddEventHandler(obj, h); err != nil {
+			return nil, fmt.Errorf("setting up %T watch in source cluster: %v", obj, err)
+		}
+	}
+
+	if err := apis.AddToScheme(dest.GetScheme()); err != nil {
+		return nil, fmt.Errorf("adding APIs to dest cluster's scheme: %v", err)
+	}
+	if err := co.WatchResourceReconcileController(dest, &v1alpha1.InnerIngress{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up InnerIngress watch in dest cluster: %v", err)
+	}
+	klog.V(1).Infof("*** ingress watch started ***")
+
+	return co, nil
+}
+
+type ingressReconciler struct {
+	*reconciler
+	ingressService types.NamespacedName
+	ingressPort    string
+	ingressClass   string
+}
+
+func (r *ingressReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	reqName := req.NamespacedName.String()
+	klog.V(1).Infof("*** inner ingress watch: %v ***", reqName)
+	ing := &extv1beta1.Ingress{}
+	if err := r.source.Get(context.TODO(), req.NamespacedName, ing); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("no ingress for %v; deleting InnerIngress, if it exists", reqName)
+			_, err := r.deleteInnerIngress(req.NamespacedName)
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, err
+	}
+
+	if ing.DeletionTimestamp != nil {
+		klog.V(1).Infof("ingress %v is being deleted", reqName)
+		return r.finalizeIngress(ing)
+	}
+
+	if !r.mirrored(ing) {
+		klog.V(1).Infof("ingress %v has a different ingress class; deleting InnerIngress, if it exists", reqName)
+		return r.finalizeIngress(ing)
+	}
+
+	if finalizer.Add(ing, innerFinalizer) {
+		klog.V(1).Infof("adding finalizer to ingress %v", reqName)
+		if err := r.source.Update(context.TODO(), ing); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	svc := &v1.Service{}
+	if err := r.source.Get(context.TODO(), r.ingressService, svc); err != nil {
+		klog.Warningf("error getting ingress controller service %s: %v", r.ingressService, err)
+		return reconcile.Result{}, err
+	}
+	nodePort, err := r.nodePort(svc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	ep := &v1.Endpoints{}
+	if err := r.source.Get(context.TODO(), r.ingressService, ep); err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+	nodes, err := r.backendNodes(svc, ep)
+	if err != nil {
+		klog.Warningf("error getting backend nodes for %v: %v", reqName, err)
+		return reconcile.Result{}, err
+	}
+
+	iing := r.makeInnerIngress(ing, nodePort, nodes)
+	reference.SetMulticlusterControllerReference(iing, reference.NewMulticlusterOwnerReference(ing, ing.GroupVersionKind(), req.Context))
+
+	cur := &v1alpha1.InnerIngress{}
+	if err := r.dest.Get(context.TODO(), r.ingressNamespacedName(req.NamespacedName), cur); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("creating new InnerIngress for %v", reqName)
+			return reconcile.Result{}, r.dest.Create(context.TODO(), iing)
+		}
+		return reconcile.Result{}, err
+	}
+
+	if !r.ownInnerIngress(cur, req.NamespacedName) {
+		klog.Warningf("InnerIngress %s/%s doesn't belong to ingress %s of cluster %q, not touching it", cur.Namespace, cur.Name, reqName, r.clusterID)
+		return reconcile.Result{}, nil
+	}
+
+	if !reflect.DeepEqual(iing.Spec, cur.Spec) {
+		klog.V(1).Infof("updating the InnerIngress for %v", reqName)
+		cur.Spec = iing.Spec
+		// wait for the outer controller to catch up with the new spec
+		return reconcile.Result{}, r.dest.Update(context.TODO(), cur)
+	}
+
+	if reflect.DeepEqual(cur.Status.LoadBalancer, ing.Status.LoadBalancer) {
+		return reconcile.Result{}, nil
+	}
+	klog.V(1).Infof("setting ingress' load balancer status to:\n%s", ToJSON(cur.Status.LoadBalancer))
+	ing.Status.LoadBalancer = *cur.Status.LoadBalancer.DeepCopy()
+	return reconcile.Result{}, r.source.Status().Update(context.TODO(), ing)
+}
+
+// nodePort returns the node port of the HTTP port of the ingress
+// controller's service
+func (r *ingressReconciler) nodePort(svc *v1.Service) (int32, error) {
+	for _, p := range svc.Spec.Ports {
+		if p.Name == r.ingressPort || strconv.Itoa(int(p.Port)) == r.ingressPort {
+			if p.NodePort == 0 {
+				return 0, fmt.Errorf("port %q of the ingress controller service %s has no node port", r.ingressPort, r.ingressService)
+			}
+			return p.NodePort, nil
+		}
+	}
+	return 0, fmt.Errorf("the ingress controller service %s has no port %q", r.ingressService, r.ingressPort)
+}
+
+// ingressNamespacedName returns the namespace and the name of the
+// InnerIngress for the inner ingress. The name ends with "-ingress-"
+// followed by a hash of the ingress' namespace and name, so that the
+// outer objects made for the InnerIngresses don't collide with the
+// ones made for the InnerServices of the services named like
+// "<name>-ingress".
+func (r *ingressReconciler) ingressNamespacedName(nsn types.NamespacedName) types.NamespacedName {
+	suffix := "-ingress-" + names.Hash("ingress:"+nsn.String())
+	return types.NamespacedName{
+		Namespace: r.targetNamespace,
+		Name:      names.Shorten(fmt.Sprintf("%s-%s-%s", r.clusterID, nsn.Namespace, nsn.Name), names.MaxLength-ingressSuffixLength) + suffix,
+	}
+}
+
+// mirrored returns true if the inner ingress is served by the inner
+// ingress controller, i.e. it has the ingress class of the
+// controller or no class at all. All of the ingresses are mirrored
+// if the class is not specified.
+func (r *ingressReconciler) mirrored(ing *extv1beta1.Ingress) bool {
+	class, found := ing.Annotations[ingressClassAnnotation]
+	return r.ingressClass == "" || !found || class == r.ingressClass
+}
+
+// ownInnerIngress returns true if the InnerIngress belongs to the
+// cluster of the controller and was made for the specified inner
+// ingress
+func (r *ingressReconciler) ownInnerIngress(iing *v1alpha1.InnerIngress, ingName types.NamespacedName) bool {
+	clusterID, found := iing.Labels[v1alpha1.ClusterLabel]
+	return found && clusterID == r.clusterID && iing.Spec.ClusterID == r.clusterID &&
+		iing.Spec.IngressNamespace == ingName.Namespace && iing.Spec.IngressName == ingName.Name
+}
+
+func (r *ingressReconciler) makeInnerIngress(ing *extv1beta1.Ingress, nodePort int32, nodes []v1alpha1.InnerServiceNode) *v1alpha1.InnerIngress {
+	var rules []v1alpha1.InnerIngressRule
+	for _, rule := range ing.Spec.Rules {
+		iRule := v1alpha1.InnerIngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			for _, p := range rule.HTTP.Paths {
+				iRule.Paths = append(iRule.Paths, p.Path)
+			}
+		}
+		rules = append(rules, iRule)
+	}
+	if len(rules) == 0 && ing.Spec.Backend != nil {
+		// the default backend gets all the requests
+		rules = []v1alpha1.InnerIngressRule{{}}
+	}
+
+	var nodeNames []string
+	for _, node := range nodes {
+		nodeNames = append(nodeNames, node.Name)
+	}
+
+	nsn := r.ingressNamespacedName(types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name})
+	return &v1alpha1.InnerIngress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: nsn.Namespace,
+			Name:      nsn.Name,
+			Labels: map[string]string{
+				v1alpha1.ClusterLabel: r.clusterID,
+			},
+		},
+		Spec: v1alpha1.InnerIngressSpec{
+			ClusterID:        r.clusterID,
+			IngressNamespace: ing.Namespace,
+			IngressName:      ing.Name,
+			Rules:            rules,
+			NodePort:         nodePort,
+			NodeNames:        nodeNames,
+			Nodes:            nodes,
+		},
+	}
+}
+
+// finalizeIngress deletes the InnerIngress of the inner ingress
+// that's being deleted or is no longer mirrored. Once the
+// InnerIngress is gone, it removes the finalizer from the ingress.
+func (r *ingressReconciler) finalizeIngress(ing *extv1beta1.Ingress) (reconcile.Result, error) {
+	ingName := types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}
+	gone, err := r.deleteInnerIngress(ingName)
+	switch {
+	case err != nil:
+		return reconcile.Result{}, err
+	case !gone:
+		klog.V(1).Infof("waiting for InnerIngress of %s to be deleted", ingName)
+		return reconcile.Result{RequeueAfter: finalizerRequeueInterval}, nil
+	case !finalizer.Has(ing, innerFinalizer):
+		return reconcile.Result{}, nil
+	}
+	klog.V(1).Infof("removing finalizer from ingress %s", ingName)
+	finalizer.Remove(ing, innerFinalizer)
+	return reconcile.Result{}, r.source.Update(context.TODO(), ing)
+}
+
+// deleteInnerIngress deletes the InnerIngress of the specified inner
+// ingress. It returns true if the InnerIngress is gone.
+func (r *ingressReconciler) deleteInnerIngress(ingName types.NamespacedName) (bool, error) {
+	iing := &v1alpha1.InnerIngress{}
+	if err := r.dest.Get(context.TODO(), r.ingressNamespacedName(ingName), iing); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if !r.ownInnerIngress(iing, ingName) {
+		return true, nil
+	}
+	if iing.DeletionTimestamp != nil {
+		return false, nil
+	}
+	if err := r.dest.Delete(context.TODO(), iing); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// ingressesForObject returns reconcile requests for all the inner
+// ingresses. Services and Endpoints other than the ones of the
+// ingress controller are ignored.
+func (r *ingressReconciler) ingressesForObject(obj interface{}) []reconcile.Request {
+	switch o := obj.(type) {
+	case *v1.Service:
+		if o.Namespace != r.ingressService.Namespace || o.Name != r.ingressService.Name {
+			return nil
+		}
+	case *v1.Endpoints:
+		if o.Namespace != r.ingressService.Namespace || o.Name != r.ingressService.Name {
+			return nil
+		}
+	case *v1.Node:
+	default:
+		return nil
+	}
+
+	var ings extv1beta1.IngressList
+	if err := r.source.List(context.TODO(), &client.ListOptions{}, &ings); err != nil {
+		klog.Warningf("error listing ingresses: %v", err)
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, ing := range ings.Items {
+		reqs = append(reqs, reconcile.Request{
+			Context: r.sourceName,
+			NamespacedName: types.NamespacedName{
+				Namespace: ing.Namespace,
+				Name:      ing.Name,
+			},
+		})
+	}
+	return reqs
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"github.com/onsi/gomega"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+func newTestIngressReconciler(t *testing.T, sourceObjs, destObjs []runtime.Object, ingressClass string) *ingressReconciler {
+	return &ingressReconciler{
+		reconciler:   newTestReconciler(t, sourceObjs, destObjs),
+		ingressClass: ingressClass,
+	}
+}
+
+func ingress(name, class string, finalizers ...string) *extv1beta1.Ingress {
+	ing := &extv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:  "default",
+			Name:       name,
+			Finalizers: finalizers,
+		},
+	}
+	if class != "" {
+		ing.Annotations = map[string]string{ingressClassAnnotation: class}
+	}
+	return ing
+}
+
+func innerIngress(r *ingressReconciler, clusterID, ingName string) *v1alpha1.InnerIngress {
+	nsn := r.ingressNamespacedName(types.NamespacedName{Namespace: "default", Name: ingName})
+	return &v1alpha1.InnerIngress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: nsn.Namespace,
+			Name:      nsn.Name,
+			Labels:    map[string]string{v1alpha1.ClusterLabel: clusterID},
+		},
+		Spec: v1alpha1.InnerIngressSpec{
+			ClusterID:        clusterID,
+			IngressNamespace: "default",
+			IngressName:      ingName,
+		},
+	}
+}
+
+func TestIngressNames(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := newTestIngressReconciler(t, nil, nil, "")
+	nsn := r.ingressNamespacedName(types.NamespacedName{Namespace: "default", Name: "foo"})
+	g.Expect(nsn.Namespace).To(gomega.Equal("outer"))
+	// the service named "foo-ingress" must not get the outer
+	// objects of the ingress "foo"
+	svcNsn := TargetNamespacedName("k8s", "outer", types.NamespacedName{Namespace: "default", Name: "foo-ingress"})
+	g.Expect(nsn).NotTo(gomega.Equal(svcNsn))
+	g.Expect(r.ingressNamespacedName(types.NamespacedName{Namespace: "default", Name: "bar"})).NotTo(gomega.Equal(nsn))
+
+	long := types.NamespacedName{Namespace: "default", Name: "a-very-long-ingress-name-that-does-not-fit-into-the-limit"}
+	g.Expect(len(r.ingressNamespacedName(long).Name)).To(gomega.BeNumerically("<=", 63))
+}
+
+func TestIngressClass(t *testing.T) {
+	for _, tc := range []struct {
+		controllerClass, ingressClass string
+		mirrored                      bool
+	}{
+		{"", "", true},
+		{"", "nginx", true},
+		{"nginx", "", true},
+		{"nginx", "nginx", true},
+		{"nginx", "traefik", false},
+	} {
+		g := gomega.NewGomegaWithT(t)
+		r := newTestIngressReconciler(t, nil, nil, tc.controllerClass)
+		g.Expect(r.mirrored(ingress("foo", tc.ingressClass))).To(gomega.Equal(tc.mirrored),
+			"controller class %q, ingress class %q", tc.controllerClass, tc.ingressClass)
+	}
+}
+
+func TestMakeInnerIngress(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := newTestIngressReconciler(t, nil, nil, "")
+	nodes := []v1alpha1.InnerServiceNode{{Name: "node1"}, {Name: "node2"}}
+
+	ing := ingress("foo", "")
+	ing.Spec.Rules = []extv1beta1.IngressRule{
+		{
+			Host: "foo.example.com",
+			IngressRuleValue: extv1beta1.IngressRuleValue{
+				HTTP: &extv1beta1.HTTPIngressRuleValue{
+					Paths: []extv1beta1.HTTPIngressPath{{Path: "/a"}, {Path: "/b"}},
+				},
+			},
+		},
+		{Host: "bar.example.com"},
+	}
+	iing := r.makeInnerIngress(ing, 30080, nodes)
+	g.Expect(iing.Labels).To(gomega.HaveKeyWithValue(v1alpha1.ClusterLabel, "k8s"))
+	g.Expect(iing.Spec).To(gomega.Equal(v1alpha1.InnerIngressSpec{
+		ClusterID:        "k8s",
+		IngressNamespace: "default",
+		IngressName:      "foo",
+		Rules: []v1alpha1.InnerIngressRule{
+			{Host: "foo.example.com", Paths: []string{"/a", "/b"}},
+			{Host: "bar.example.com"},
+		},
+		NodePort:  30080,
+		NodeNames: []string{"node1", "node2"},
+		Nodes:     nodes,
+	}))
+
+	// the default backend gets all the requests
+	ing = ingress("foo", "")
+	ing.Spec.Backend = &extv1beta1.IngressBackend{ServiceName: "foo", ServicePort: intstr.FromInt(80)}
+	g.Expect(r.makeInnerIngress(ing, 30080, nodes).Spec.Rules).To(gomega.Equal([]v1alpha1.InnerIngressRule{{}}))
+}
+
+func innerIngressNames(g *gomega.GomegaWithT, r *ingressReconciler) []string {
+	var iings v1alpha1.InnerIngressList
+	g.Expect(r.dest.List(context.TODO(), &client.ListOptions{}, &iings)).To(gomega.Succeed())
+	var names []string
+	for _, iing := range iings.Items {
+		names = append(names, iing.Spec.ClusterID+"/"+iing.Spec.IngressName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIngressSweep(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := newTestIngressReconciler(t, []runtime.Object{
+		ingress("ok", ""),
+		ingress("missing", ""),
+		ingress("other-class", "traefik"),
+	}, nil, "nginx")
+	for _, iing := range []*v1alpha1.InnerIngress{
+		innerIngress(r, "k8s", "ok"),
+		innerIngress(r, "k8s", "deleted"),
+		innerIngress(r, "k8s", "other-class"),
+		// belongs to another cluster
+		innerIngress(r, "other", "foreign"),
+	} {
+		g.Expect(r.dest.Create(context.TODO(), iing)).To(gomega.Succeed())
+	}
+
+	var resynced []types.NamespacedName
+	g.Expect(r.sweep(sweeper.New("ingress", sweeper.Options{}, nil), func(nsn types.NamespacedName) {
+		resynced = append(resynced, nsn)
+	})).To(gomega.Succeed())
+	g.Expect(resynced).To(gomega.Equal([]types.NamespacedName{{Namespace: "default", Name: "missing"}}))
+	g.Expect(innerIngressNames(g, r)).To(gomega.Equal([]string{"k8s/ok", "other/foreign"}))
+}
+
+func TestIngressSweepUnmirrored(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := newTestIngressReconciler(t, []runtime.Object{
+		ingress("mirrored", "", innerFinalizer),
+		ingress("stale", "", innerFinalizer),
+		ingress("other", ""),
+	}, nil, "")
+	g.Expect(r.dest.Create(context.TODO(), innerIngress(r, "k8s", "mirrored"))).To(gomega.Succeed())
+
+	finalizers := func(name string) []string {
+		ing := &extv1beta1.Ingress{}
+		g.Expect(r.source.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, ing)).To(gomega.Succeed())
+		return ing.Finalizers
+	}
+
+	s := sweeper.New("ingress", sweeper.Options{}, nil)
+	g.Expect(r.sweepUnmirrored(s)).To(gomega.Succeed())
+	g.Expect(innerIngressNames(g, r)).To(gomega.BeEmpty())
+	// the finalizer is kept until the InnerIngress is gone
+	g.Expect(finalizers("mirrored")).To(gomega.Equal([]string{innerFinalizer}))
+	g.Expect(finalizers("stale")).To(gomega.BeEmpty())
+
+	g.Expect(r.sweepUnmirrored(s)).To(gomega.Succeed())
+	g.Expect(finalizers("mirrored")).To(gomega.BeEmpty())
+	g.Expect(finalizers("other")).To(gomega.BeEmpty())
+}
+
+func TestIngressOfOtherClassNotMirrored(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	// the ingress used to be mirrored before its class was changed
+	r := newTestIngressReconciler(t, []runtime.Object{ingress("foo", "traefik", innerFinalizer)}, nil, "nginx")
+	iing := innerIngress(r, "k8s", "foo")
+	g.Expect(r.dest.Create(context.TODO(), iing)).To(gomega.Succeed())
+	req := reconcile.Request{
+		Context:        "inner",
+		NamespacedName: types.NamespacedName{Namespace: "default", Name: "foo"},
+	}
+
+	// the first pass deletes the InnerIngress, the second one
+	// removes the finalizer
+	for i := 0; i < 2; i++ {
+		_, err := r.Reconcile(req)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+	err := r.dest.Get(context.TODO(), types.NamespacedName{Namespace: iing.Namespace, Name: iing.Name}, &v1alpha1.InnerIngress{})
+	g.Expect(errors.IsNotFound(err)).To(gomega.BeTrue())
+	ing := &extv1beta1.Ingress{}
+	g.Expect(r.source.Get(context.TODO(), req.NamespacedName, ing)).To(gomega.Succeed())
+	g.Expect(ing.Finalizers).To(gomega.BeEmpty())
+}
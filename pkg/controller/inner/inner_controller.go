@@ -39,6 +39,9 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"admiralty.io/multicluster-controller/pkg/cluster"
 	"admiralty.io/multicluster-controller/pkg/controller"
@@ -46,10 +49,13 @@ import (
 	"admiralty.io/multicluster-controller/pkg/reference"
 	"github.com/ivan4th/virtletlb/pkg/apis"
 	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/finalizer"
+	"github.com/ivan4th/virtletlb/pkg/handler"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -62,10 +68,56 @@ func ToJSON(o interface{}) string {
 	return string(bs)
 }
 
+const (
+	// metalLBIPsAnnotation is MetalLB's equivalent of
+	// spec.loadBalancerIP which may hold a comma-separated list
+	// of IPs
+	metalLBIPsAnnotation = "metallb.universe.tf/loadBalancerIPs"
+	// sourceRangesAnnotation is the legacy way to specify
+	// spec.loadBalancerSourceRanges
+	sourceRangesAnnotation = "service.beta.kubernetes.io/load-balancer-source-ranges"
+	// lastAppliedAnnotation is set by kubectl apply and is never
+	// passed to the outer cluster
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+	// innerFinalizer is set on the inner LoadBalancer services so
+	// that their InnerServices and thus the outer services are
+	// guaranteed to be deleted with them
+	innerFinalizer = "virtletlb.virtlet.cloud/inner-controller"
+	// exposeNodePortAnnotation set to "true" on an inner NodePort
+	// service makes it exposed through the outer cluster
+	exposeNodePortAnnotation = "virtletlb.virtlet.cloud/expose-node-port"
+	// outerNodePortsAnnotation is set on the exposed inner NodePort
+	// services to report the outer node ports, e.g.
+	// "80/TCP=31080,443/TCP=31443"
+	outerNodePortsAnnotation = "virtletlb.virtlet.cloud/outer-node-ports"
+	// finalizerRequeueInterval specifies how often the deletion of
+	// the dependent objects is checked during the finalization
+	finalizerRequeueInterval = 2 * time.Second
+	// requestedIPTimeout specifies how long the outer cluster may
+	// take to assign the requested load balancer IP before a
+	// warning event is recorded for the service
+	requestedIPTimeout = time.Minute
+)
+
 var skipRx *regexp.Regexp = regexp.MustCompile("^kube-system/(kube-scheduler|kube-controller-manager)$")
 
-func NewController(source *cluster.Cluster, dest *cluster.Cluster, targetNamespace string) (*controller.Controller, error) {
-	klog.V(1).Infof("*** starting watch (targetNamespace: %v) ***", targetNamespace)
+// Options specifies the options of the inner controller
+type Options struct {
+	// ClusterID is the ID of the inner cluster
+	ClusterID string
+	// PodRefKey is the key of the node label or annotation that
+	// holds the name or the UID of the outer pod of the node
+	PodRefKey string
+	// Recorder is used to record the events for the inner services
+	Recorder record.EventRecorder
+	// ExposeNodePorts makes all the inner NodePort services exposed
+	// through the outer cluster, not just the ones that have the
+	// expose-node-port annotation
+	ExposeNodePorts bool
+}
+
+func NewController(source *cluster.Cluster, dest *cluster.Cluster, targetNamespace string, opts Options) (*controller.Controller, error) {
+	klog.V(1).Infof("*** starting watch (targetNamespace: %v, clusterID: %v) ***", targetNamespace, opts.ClusterID)
 	sourceclient, err := source.GetDelegatingClient()
 	if err != nil {
 		return nil, fmt.Errorf("getting delegating client for source cluster: %v", err)
@@ -75,15 +127,38 @@ func NewController(source *cluster.Cluster, dest *cluster.Cluster, targetNamespa
 		return nil, fmt.Errorf("getting delegating client for dest cluster: %v", err)
 	}
 
-	co := controller.New(&reconciler{
+	r := &reconciler{
 		source:          sourceclient,
 		dest:            destclient,
+		sourceName:      source.GetClusterName(),
 		targetNamespace: targetNamespace,
-	}, controller.Options{})
+		clusterID:       opts.ClusterID,
+		podRefKey:       opts.PodRefKey,
+		recorder:        opts.Recorder,
+		exposeNodePorts: opts.ExposeNodePorts,
+	}
+	co := controller.New(r, controller.Options{})
 
 	if err := co.WatchResourceReconcileObject(source, &v1.Endpoints{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up Endpoints watch in source cluster: %v", err)
+	}
+	// the services are reconciled using the same key as their
+	// Endpoints, so changes in the services' type, ports or
+	// annotations are picked up, as well as the services that
+	// have no Endpoints yet, and the services' finalizers are
+	// handled when they're deleted
+	if err := co.WatchResourceReconcileObject(source, &v1.Service{}, controller.WatchOptions{}); err != nil {
 		return nil, fmt.Errorf("setting up Service watch in source cluster: %v", err)
 	}
+	// the nodes that may serve the services depend on the nodes'
+	// readiness, cordoning and labels
+	if err := source.AddEventHandler(&v1.Node{}, &handler.EnqueueRequestsFromMapFunc{
+		Queue:        co.Queue,
+		ToRequests:   r.servicesForNode,
+		UpdateFilter: r.nodeChanged,
+	}); err != nil {
+		return nil, fmt.Errorf("setting up Node watch in source cluster: %v", err)
+	}
 
 	if err := apis.AddToScheme(dest.GetScheme()); err != nil {
 		return nil, fmt.Errorf("adding APIs to dest cluster's scheme: %v", err)
@@ -104,7 +179,12 @@ func NewController(source *cluster.Cluster, dest *cluster.Cluster, targetNamespa
 type reconciler struct {
 	source          client.Client
 	dest            client.Client
+	sourceName      string
 	targetNamespace string
+	clusterID       string
+	podRefKey       string
+	recorder        record.EventRecorder
+	exposeNodePorts bool
 }
 
 func (r *reconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
@@ -114,104 +194,363 @@ func (r *reconciler) Reconcile(req reconcile.Request) (reconcile.Result, error)
 	}
 
 	klog.V(1).Infof("*** inner watch: %v ***", reqName)
-	ep := &v1.Endpoints{}
-	if err := r.source.Get(context.TODO(), req.NamespacedName, ep); err != nil {
-		if errors.IsNotFound(err) {
-			klog.V(1).Infof("no endpoints for %v; deleting InnerService, if it exists", reqName)
-			// ...TODO: multicluster garbage collector
-			// Until then...
-			err := r.deleteInnerService(r.targetNamespacedName(req.NamespacedName))
-			return reconcile.Result{}, err
-		}
-		klog.Warningf("get endpoints error: %v", err)
-		return reconcile.Result{}, err
-	}
-
 	svc := &v1.Service{}
 	if err := r.source.Get(context.TODO(), req.NamespacedName, svc); err != nil {
 		if errors.IsNotFound(err) {
+			// this may only happen to the services which don't
+			// have the finalizer, e.g. the ones that were
+			// deleted before they were seen by the controller
 			klog.V(1).Infof("no service for %v; deleting InnerService, if it exists", reqName)
-			// ...TODO: multicluster garbage collector
-			// Until then...
-			err := r.deleteInnerService(r.targetNamespacedName(req.NamespacedName))
+			_, err := r.deleteInnerService(req.NamespacedName)
 			return reconcile.Result{}, err
 		}
 		klog.Warningf("get svc error: %v", err)
 		return reconcile.Result{}, err
 	}
 
-	if svc.Spec.Type != "LoadBalancer" {
-		klog.V(1).Infof("wrong service type %q for %v; deleting InnerService, if it exists", svc.Spec.Type, reqName)
-		err := r.deleteInnerService(r.targetNamespacedName(req.NamespacedName))
+	if svc.DeletionTimestamp != nil {
+		klog.V(1).Infof("service %v is being deleted", reqName)
+		return r.finalizeService(svc)
+	}
+
+	if !r.exposed(svc) {
+		klog.V(1).Infof("service %v of type %q is not exposed; deleting InnerService, if it exists", reqName, svc.Spec.Type)
+		return r.finalizeService(svc)
+	}
+
+	if finalizer.Add(svc, innerFinalizer) {
+		klog.V(1).Infof("adding finalizer to service %v", reqName)
+		if err := r.source.Update(context.TODO(), svc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	ep := &v1.Endpoints{}
+	if err := r.source.Get(context.TODO(), req.NamespacedName, ep); err != nil {
+		if !errors.IsNotFound(err) {
+			klog.Warningf("get endpoints error: %v", err)
+			return reconcile.Result{}, err
+		}
+		// the Endpoints may not have been created yet, or the
+		// service may have no selector; the InnerService is
+		// published anyway, with no endpoint nodes
+		klog.V(1).Infof("no endpoints for %v yet", reqName)
+		ep = &v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: svc.Namespace,
+				Name:      svc.Name,
+			},
+		}
+	}
+
+	nodes, err := r.backendNodes(svc, ep)
+	if err != nil {
+		klog.Warningf("error getting backend nodes for %v: %v", reqName, err)
 		return reconcile.Result{}, err
 	}
 
-	innerSvc := r.makeInnerService(svc, ep)
-	reference.SetMulticlusterControllerReference(innerSvc, reference.NewMulticlusterOwnerReference(ep, ep.GroupVersionKind(), req.Context))
+	innerSvc := MakeInnerService(svc, r.clusterID, r.targetNamespace, nodes)
+	reference.SetMulticlusterControllerReference(innerSvc, reference.NewMulticlusterOwnerReference(svc, svc.GroupVersionKind(), req.Context))
 
 	curInnerSvc := &v1alpha1.InnerService{}
 	if err := r.dest.Get(context.TODO(), r.targetNamespacedName(req.NamespacedName), curInnerSvc); err != nil {
 		if errors.IsNotFound(err) {
 			klog.V(1).Infof("creating new InnerService for %v", reqName)
-			err := r.dest.Create(context.TODO(), innerSvc)
-			return reconcile.Result{}, err
+			return reconcile.Result{}, CreateInnerService(context.TODO(), r.dest, innerSvc, svc, nodes)
 		}
 		klog.Warningf("get dest innersvc error: %v", err)
 		return reconcile.Result{}, err
 	}
 
-	if reflect.DeepEqual(innerSvc.Spec, curInnerSvc.Spec) {
+	if !r.ownInnerService(curInnerSvc, req.NamespacedName) {
+		klog.Warningf("InnerService %s/%s doesn't belong to service %s of cluster %q, not touching it", curInnerSvc.Namespace, curInnerSvc.Name, reqName, r.clusterID)
+		return reconcile.Result{}, nil
+	}
+
+	specMatches := reflect.DeepEqual(innerSvc.Spec, curInnerSvc.Spec)
+	if specMatches {
 		klog.V(1).Infof("src and dst service specs match")
-		var err error
-		if curInnerSvc.Status.LoadBalancerIP != innerSvc.Status.LoadBalancerIP {
-			klog.V(1).Infof("setting service's LbIP to %s", curInnerSvc.Status.LoadBalancerIP)
-			svc.Status = v1.ServiceStatus{
-				LoadBalancer: v1.LoadBalancerStatus{
-					Ingress: []v1.LoadBalancerIngress{
-						{
-							IP: curInnerSvc.Status.LoadBalancerIP,
-						},
-					},
-				},
-			}
-			err = r.source.Status().Update(context.TODO(), svc)
-		} else {
-			klog.V(1).Infof("keeping inner service's LbIP %s", curInnerSvc.Status.LoadBalancerIP)
-		}
-		return reconcile.Result{}, err
 	} else {
 		klog.V(1).Infof("spec mismatch! WAS:\n%s\n\nNOW:\n%s\n", ToJSON(curInnerSvc.Spec), ToJSON(innerSvc.Spec))
+		klog.V(1).Infof("updating the InnerService")
+		curInnerSvc.Spec = innerSvc.Spec
+		if err := r.dest.Update(context.TODO(), curInnerSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if SetNodesAvailableCondition(&curInnerSvc.Status, svc, nodes) {
+		klog.V(1).Infof("updating the InnerService conditions")
+		if err := r.dest.Status().Update(context.TODO(), curInnerSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if !specMatches {
+		// wait for the outer controller to catch up with the new spec
+		return reconcile.Result{}, nil
+	}
+
+	if svc.Spec.Type == v1.ServiceTypeNodePort {
+		return reconcile.Result{}, r.reportNodePorts(svc, curInnerSvc)
+	}
+
+	if _, found := svc.Annotations[outerNodePortsAnnotation]; found {
+		// the service used to be an exposed NodePort service
+		klog.V(1).Infof("removing service's outer node ports annotation")
+		delete(svc.Annotations, outerNodePortsAnnotation)
+		if err := r.source.Update(context.TODO(), svc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	lbStatus := r.loadBalancerStatus(svc, curInnerSvc)
+	if !reflect.DeepEqual(lbStatus, svc.Status.LoadBalancer) {
+		klog.V(1).Infof("setting service's load balancer status to:\n%s", ToJSON(lbStatus))
+		svc.Status.LoadBalancer = lbStatus
+		err = r.source.Status().Update(context.TODO(), svc)
+	} else {
+		klog.V(1).Infof("keeping inner service's load balancer status")
+	}
+	return reconcile.Result{RequeueAfter: r.checkRequestedIP(svc, curInnerSvc)}, err
+}
+
+// exposed returns true if the service must be exposed through the
+// outer cluster. These are the LoadBalancer services and, if enabled,
+// the NodePort services.
+func (r *reconciler) exposed(svc *v1.Service) bool {
+	switch svc.Spec.Type {
+	case v1.ServiceTypeLoadBalancer:
+		return true
+	case v1.ServiceTypeNodePort:
+		return r.exposeNodePorts || svc.Annotations[exposeNodePortAnnotation] == "true"
+	default:
+		return false
+	}
+}
+
+// reportNodePorts sets the annotation of the inner NodePort service
+// that lists the outer node ports assigned to its ports
+func (r *reconciler) reportNodePorts(svc *v1.Service, isvc *v1alpha1.InnerService) error {
+	var ports []string
+	for _, p := range isvc.Status.NodePorts {
+		if p.NodePort != 0 {
+			ports = append(ports, fmt.Sprintf("%d/%s=%d", p.Port, p.Protocol, p.NodePort))
+		}
+	}
+	value := strings.Join(ports, ",")
+	if svc.Annotations[outerNodePortsAnnotation] == value {
+		klog.V(1).Infof("keeping inner service's outer node ports annotation")
+		return nil
+	}
+	klog.V(1).Infof("setting service's outer node ports annotation to %q", value)
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	svc.Annotations[outerNodePortsAnnotation] = value
+	return r.source.Update(context.TODO(), svc)
+}
+
+// loadBalancerStatus returns the load balancer status to be set on
+// the inner service. If the service requested a specific IP but the
+// outer cluster assigned different address(es), the status is left
+// empty and a warning event is recorded for the service instead.
+func (r *reconciler) loadBalancerStatus(svc *v1.Service, isvc *v1alpha1.InnerService) v1.LoadBalancerStatus {
+	lbStatus := *isvc.Status.LoadBalancer.DeepCopy()
+	requestedIP := isvc.Spec.LoadBalancerIP
+	if requestedIP == "" || len(lbStatus.Ingress) == 0 {
+		return lbStatus
+	}
+
+	var assigned []string
+	for _, ingress := range lbStatus.Ingress {
+		if ingress.IP == requestedIP {
+			return lbStatus
+		}
+		if ingress.IP != "" {
+			assigned = append(assigned, ingress.IP)
+		} else {
+			assigned = append(assigned, ingress.Hostname)
+		}
 	}
 
-	klog.V(1).Infof("updating the InnerService")
-	curInnerSvc.Spec = innerSvc.Spec
-	err := r.dest.Update(context.TODO(), curInnerSvc)
-	return reconcile.Result{}, err
+	r.recorder.Eventf(svc, v1.EventTypeWarning, "LoadBalancerIPMismatch",
+		"Requested load balancer IP %s, but the outer cluster assigned %s",
+		requestedIP, strings.Join(assigned, ", "))
+	return v1.LoadBalancerStatus{}
 }
 
-func (r *reconciler) targetNamespacedName(pod types.NamespacedName) types.NamespacedName {
-	return types.NamespacedName{
-		Namespace: r.targetNamespace,
-		Name:      fmt.Sprintf("%s-%s", pod.Namespace, pod.Name),
+// checkRequestedIP records a warning event for the service if the
+// outer cluster didn't assign any address to it within
+// requestedIPTimeout after it requested a specific IP, which usually
+// means that the outer load balancer rejected the IP. It returns the
+// interval after which the check must be repeated, or 0 if it's not
+// needed.
+func (r *reconciler) checkRequestedIP(svc *v1.Service, isvc *v1alpha1.InnerService) time.Duration {
+	requestedIP := isvc.Spec.LoadBalancerIP
+	if requestedIP == "" || len(isvc.Status.LoadBalancer.Ingress) != 0 {
+		return 0
 	}
+	c := isvc.Status.GetCondition(v1alpha1.InnerServiceAddressAssigned)
+	if c == nil || c.Status != v1.ConditionFalse {
+		// the outer controller didn't process the InnerService yet
+		return requestedIPTimeout
+	}
+	pending := time.Since(c.LastTransitionTime.Time)
+	if pending < requestedIPTimeout {
+		return requestedIPTimeout - pending
+	}
+	r.recorder.Eventf(svc, v1.EventTypeWarning, "LoadBalancerIPPending",
+		"Requested load balancer IP %s, but the outer cluster didn't assign any address for %v: %s",
+		requestedIP, pending.Round(time.Second), c.Message)
+	return requestedIPTimeout
+}
+
+func (r *reconciler) targetNamespacedName(nsn types.NamespacedName) types.NamespacedName {
+	return TargetNamespacedName(r.clusterID, r.targetNamespace, nsn)
 }
 
-func (r *reconciler) deleteInnerService(nsn types.NamespacedName) error {
+func (r *reconciler) ownInnerService(isvc *v1alpha1.InnerService, svcName types.NamespacedName) bool {
+	return OwnInnerService(isvc, r.clusterID, svcName)
+}
+
+// finalizeService deletes the InnerService of the inner service
+// that's being deleted or is no longer a LoadBalancer service. Once
+// the InnerService is gone, which means that the outer service is
+// gone, too, it clears the service's load balancer status and
+// removes the finalizer from it.
+func (r *reconciler) finalizeService(svc *v1.Service) (reconcile.Result, error) {
+	svcName := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+	gone, err := r.deleteInnerService(svcName)
+	switch {
+	case err != nil:
+		return reconcile.Result{}, err
+	case !gone:
+		klog.V(1).Infof("waiting for InnerService of %s to be deleted", svcName)
+		return reconcile.Result{RequeueAfter: finalizerRequeueInterval}, nil
+	case !finalizer.Has(svc, innerFinalizer):
+		return reconcile.Result{}, nil
+	}
+
+	if len(svc.Status.LoadBalancer.Ingress) > 0 {
+		klog.V(1).Infof("clearing load balancer status of %s", svcName)
+		svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+		if err := r.source.Status().Update(context.TODO(), svc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	klog.V(1).Infof("removing finalizer from service %s", svcName)
+	finalizer.Remove(svc, innerFinalizer)
+	delete(svc.Annotations, outerNodePortsAnnotation)
+	return reconcile.Result{}, r.source.Update(context.TODO(), svc)
+}
+
+// deleteInnerService deletes the InnerService of the specified inner
+// service. It returns true if the InnerService is gone.
+func (r *reconciler) deleteInnerService(svcName types.NamespacedName) (bool, error) {
+	nsn := r.targetNamespacedName(svcName)
 	g := &v1alpha1.InnerService{}
 	if err := r.dest.Get(context.TODO(), nsn, g); err != nil {
 		if errors.IsNotFound(err) {
 			// all good
-			return nil
+			return true, nil
 		}
-		return err
+		return false, err
+	}
+	if !r.ownInnerService(g, svcName) {
+		klog.Warningf("InnerService %s doesn't belong to service %s of cluster %q, not deleting it", nsn, svcName, r.clusterID)
+		return true, nil
+	}
+	if g.DeletionTimestamp != nil {
+		// the outer controller is cleaning up
+		return false, nil
 	}
 	if err := r.dest.Delete(context.TODO(), g); err != nil {
-		return err
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// backendNodes returns the nodes that can serve the service's node
+// ports. For externalTrafficPolicy: Local these are the nodes that
+// host the service endpoints, otherwise these are all the nodes of
+// the cluster. Either way, the nodes that aren't ready, are cordoned
+// or are excluded from the load balancers are skipped.
+func (r *reconciler) backendNodes(svc *v1.Service, ep *v1.Endpoints) ([]v1alpha1.InnerServiceNode, error) {
+	var endpointNodes map[string]bool
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		endpointNodes = make(map[string]bool)
+		for _, name := range endpointNodeNames(ep) {
+			endpointNodes[name] = true
+		}
+	}
+
+	var nodeList v1.NodeList
+	if err := r.source.List(context.TODO(), &client.ListOptions{}, &nodeList); err != nil {
+		return nil, err
 	}
-	return nil
+	var nodes []v1alpha1.InnerServiceNode
+	for n := range nodeList.Items {
+		node := &nodeList.Items[n]
+		if (endpointNodes != nil && !endpointNodes[node.Name]) || !NodeUsable(node) {
+			continue
+		}
+		nodes = append(nodes, NodeDetails(node, r.podRefKey))
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes, nil
 }
 
-func (r *reconciler) makeInnerService(svc *v1.Service, ep *v1.Endpoints) *v1alpha1.InnerService {
+// servicesForNode returns reconcile requests for the exposed
+// services, as any of them may use the node
+func (r *reconciler) servicesForNode(obj interface{}) []reconcile.Request {
+	if _, ok := obj.(*v1.Node); !ok {
+		return nil
+	}
+
+	var svcs v1.ServiceList
+	if err := r.source.List(context.TODO(), &client.ListOptions{}, &svcs); err != nil {
+		klog.Warningf("error listing services: %v", err)
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, svc := range svcs.Items {
+		if !r.exposed(&svc) {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{
+			Context: r.sourceName,
+			NamespacedName: types.NamespacedName{
+				Namespace: svc.Namespace,
+				Name:      svc.Name,
+			},
+		})
+	}
+	return reqs
+}
+
+// nodeChanged returns true if the node update may affect the
+// InnerServices. The nodes' status is updated often because of the
+// heartbeats, which must not cause the services to be reconciled.
+func (r *reconciler) nodeChanged(oldObj, newObj interface{}) bool {
+	oldNode, ok := oldObj.(*v1.Node)
+	if !ok {
+		return true
+	}
+	newNode, ok := newObj.(*v1.Node)
+	if !ok {
+		return true
+	}
+	return NodeUsable(oldNode) != NodeUsable(newNode) ||
+		!reflect.DeepEqual(NodeDetails(oldNode, r.podRefKey), NodeDetails(newNode, r.podRefKey))
+}
+
+func endpointNodeNames(ep *v1.Endpoints) []string {
 	var nodeNames []string
 	gotNodeNames := map[string]bool{}
 	for _, s := range ep.Subsets {
@@ -225,33 +564,6 @@ func (r *reconciler) makeInnerService(svc *v1.Service, ep *v1.Endpoints) *v1alph
 			}
 		}
 	}
-
-	lbIP := ""
-	if len(svc.Status.LoadBalancer.Ingress) > 0 {
-		lbIP = svc.Status.LoadBalancer.Ingress[0].IP
-	}
-
-	var ports []v1alpha1.InnerServicePort
-	for _, p := range svc.Spec.Ports {
-		ports = append(ports, v1alpha1.InnerServicePort{
-			Name:     p.Name,
-			Protocol: p.Protocol,
-			Port:     p.Port,
-			NodePort: p.NodePort,
-		})
-	}
-
-	return &v1alpha1.InnerService{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: r.targetNamespace,
-			Name:      fmt.Sprintf("%s-%s", ep.Namespace, ep.Name),
-		},
-		Spec: v1alpha1.InnerServiceSpec{
-			NodeNames: nodeNames,
-			Ports:     ports,
-		},
-		Status: v1alpha1.InnerServiceStatus{
-			LoadBalancerIP: lbIP,
-		},
-	}
+	sort.Strings(nodeNames)
+	return nodeNames
 }
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"testing"
+
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/ivan4th/virtletlb/pkg/apis"
+)
+
+func newTestReconciler(t *testing.T, sourceObjs, destObjs []runtime.Object) *reconciler {
+	if err := apis.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("error adding APIs to the scheme: %v", err)
+	}
+	return &reconciler{
+		source:          fake.NewFakeClient(sourceObjs...),
+		dest:            fake.NewFakeClient(destObjs...),
+		sourceName:      "inner",
+		targetNamespace: "outer",
+		clusterID:       "k8s",
+		recorder:        record.NewFakeRecorder(10),
+	}
+}
+
+func TestNodePortsAnnotationRemovedFromLoadBalancers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	// the service used to be an exposed NodePort service
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo",
+			Annotations: map[string]string{outerNodePortsAnnotation: "80/TCP=31080"},
+			Finalizers:  []string{innerFinalizer},
+		},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	r := newTestReconciler(t, []runtime.Object{svc}, nil)
+	req := reconcile.Request{
+		Context:        "inner",
+		NamespacedName: types.NamespacedName{Namespace: "default", Name: "foo"},
+	}
+
+	// the first pass creates the InnerService, the second one
+	// syncs the service
+	for i := 0; i < 2; i++ {
+		_, err := r.Reconcile(req)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+	updated := &v1.Service{}
+	g.Expect(r.source.Get(context.TODO(), req.NamespacedName, updated)).To(gomega.Succeed())
+	g.Expect(updated.Annotations).NotTo(gomega.HaveKey(outerNodePortsAnnotation))
+}
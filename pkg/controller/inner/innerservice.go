@@ -0,0 +1,253 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/names"
+)
+
+const (
+	// excludeBalancerLabel marks the nodes that must not serve the
+	// load balancers
+	excludeBalancerLabel = "node.kubernetes.io/exclude-from-external-load-balancers"
+	// legacyExcludeBalancerLabel is the older equivalent of
+	// excludeBalancerLabel
+	legacyExcludeBalancerLabel = "alpha.service-controller.kubernetes.io/exclude-balancer"
+)
+
+// The functions in this file are shared by the inner controller and
+// the cloud provider, see the ccm package.
+
+// TargetNamespacedName returns the namespace and the name of the
+// InnerService for the inner service. The name includes the cluster
+// ID so that the services of different inner clusters that share
+// the same outer namespace don't collide. It's shortened if needed
+// so that it can be used as the name of the outer service.
+func TargetNamespacedName(clusterID, targetNamespace string, nsn types.NamespacedName) types.NamespacedName {
+	return types.NamespacedName{
+		Namespace: targetNamespace,
+		Name:      names.Shorten(fmt.Sprintf("%s-%s-%s", clusterID, nsn.Namespace, nsn.Name), names.MaxLength),
+	}
+}
+
+// OwnInnerService returns true if the InnerService belongs to the
+// cluster with the specified ID and was made for the specified inner
+// service. The latter guards against collisions of the shortened
+// names.
+func OwnInnerService(isvc *v1alpha1.InnerService, clusterID string, svcName types.NamespacedName) bool {
+	id, found := isvc.Labels[v1alpha1.ClusterLabel]
+	if !found || id != clusterID || isvc.Spec.ClusterID != clusterID {
+		return false
+	}
+	return isvc.Spec.ServiceNamespace == "" ||
+		(isvc.Spec.ServiceNamespace == svcName.Namespace && isvc.Spec.ServiceName == svcName.Name)
+}
+
+// NodeDetails returns the information the outer controller needs
+// to find the VM pod for the node. podRefKey is the key of the node
+// label or annotation that holds the name or the UID of the pod.
+func NodeDetails(node *v1.Node, podRefKey string) v1alpha1.InnerServiceNode {
+	details := v1alpha1.InnerServiceNode{
+		Name:       node.Name,
+		ProviderID: node.Spec.ProviderID,
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP {
+			details.InternalIP = addr.Address
+			break
+		}
+	}
+	if podRefKey != "" {
+		details.PodRef = node.Labels[podRefKey]
+		if details.PodRef == "" {
+			details.PodRef = node.Annotations[podRefKey]
+		}
+	}
+	return details
+}
+
+// NodeUsable returns true if the node can serve the load balancers,
+// that is, it's ready, not cordoned and not excluded from the load
+// balancers via a label
+func NodeUsable(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for _, label := range []string{excludeBalancerLabel, legacyExcludeBalancerLabel} {
+		if _, found := node.Labels[label]; found {
+			return false
+		}
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// CreateInnerService creates the InnerService for the inner service
+// and sets its NodesAvailable condition. The status of the new
+// InnerService is ignored on create because of the status
+// subresource, so it's written by a separate update.
+func CreateInnerService(ctx context.Context, c client.Client, isvc *v1alpha1.InnerService, svc *v1.Service, nodes []v1alpha1.InnerServiceNode) error {
+	if err := c.Create(ctx, isvc); err != nil {
+		return err
+	}
+	SetNodesAvailableCondition(&isvc.Status, svc, nodes)
+	return c.Status().Update(ctx, isvc)
+}
+
+// SetNodesAvailableCondition sets NodesAvailable condition of the
+// InnerService depending on whether there are any nodes that can
+// serve the service. It returns true if the condition has changed.
+func SetNodesAvailableCondition(status *v1alpha1.InnerServiceStatus, svc *v1.Service, nodes []v1alpha1.InnerServiceNode) bool {
+	switch {
+	case len(nodes) > 0:
+		return status.SetCondition(v1alpha1.InnerServiceNodesAvailable, v1.ConditionTrue, "NodesAvailable",
+			fmt.Sprintf("%d node(s) available", len(nodes)))
+	case svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal:
+		return status.SetCondition(v1alpha1.InnerServiceNodesAvailable, v1.ConditionFalse, "NoEndpointNodes",
+			"None of the usable nodes hosts ready endpoints of the service")
+	default:
+		return status.SetCondition(v1alpha1.InnerServiceNodesAvailable, v1.ConditionFalse, "NoReadyNodes",
+			"None of the nodes are ready, schedulable and not excluded from the load balancers")
+	}
+}
+
+// MakeInnerService makes the InnerService for the inner LoadBalancer
+// or NodePort service of the cluster with the specified ID, to be
+// placed in the target namespace of the outer cluster. nodes are the
+// nodes that can serve the service's node ports.
+func MakeInnerService(svc *v1.Service, clusterID, targetNamespace string, nodes []v1alpha1.InnerServiceNode) *v1alpha1.InnerService {
+	trafficPolicy := svc.Spec.ExternalTrafficPolicy
+	if trafficPolicy == "" {
+		trafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	}
+
+	var ports []v1alpha1.InnerServicePort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1alpha1.InnerServicePort{
+			Name:     p.Name,
+			Protocol: p.Protocol,
+			Port:     p.Port,
+			NodePort: p.NodePort,
+		})
+	}
+
+	var nodeNames []string
+	for _, node := range nodes {
+		nodeNames = append(nodeNames, node.Name)
+	}
+
+	svcType := v1.ServiceTypeLoadBalancer
+	var lbIP string
+	var sourceRanges []string
+	if svc.Spec.Type == v1.ServiceTypeNodePort {
+		svcType = v1.ServiceTypeNodePort
+	} else {
+		lbIP = requestedLoadBalancerIP(svc)
+		sourceRanges = loadBalancerSourceRanges(svc)
+	}
+
+	nsn := TargetNamespacedName(clusterID, targetNamespace, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name})
+	return &v1alpha1.InnerService{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: nsn.Namespace,
+			Name:      nsn.Name,
+			Labels: map[string]string{
+				v1alpha1.ClusterLabel: clusterID,
+			},
+		},
+		Spec: v1alpha1.InnerServiceSpec{
+			ClusterID:                clusterID,
+			ServiceNamespace:         svc.Namespace,
+			ServiceName:              svc.Name,
+			Type:                     svcType,
+			NodeNames:                nodeNames,
+			Nodes:                    nodes,
+			Ports:                    ports,
+			ExternalTrafficPolicy:    trafficPolicy,
+			HealthCheckNodePort:      svc.Spec.HealthCheckNodePort,
+			LoadBalancerIP:           lbIP,
+			LoadBalancerSourceRanges: sourceRanges,
+			Labels:                   copyStringMap(svc.Labels),
+			Annotations:              copyStringMap(svc.Annotations, lastAppliedAnnotation, outerNodePortsAnnotation),
+			SessionAffinity:          svc.Spec.SessionAffinity,
+			SessionAffinityConfig:    svc.Spec.SessionAffinityConfig.DeepCopy(),
+		},
+	}
+}
+
+// requestedLoadBalancerIP returns the load balancer IP requested
+// for the service via spec.loadBalancerIP or MetalLB annotation
+func requestedLoadBalancerIP(svc *v1.Service) string {
+	if svc.Spec.LoadBalancerIP != "" {
+		return svc.Spec.LoadBalancerIP
+	}
+	for _, ip := range strings.Split(svc.Annotations[metalLBIPsAnnotation], ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// loadBalancerSourceRanges returns the source ranges of the service
+// specified either via spec.loadBalancerSourceRanges or the
+// corresponding annotation
+func loadBalancerSourceRanges(svc *v1.Service) []string {
+	if len(svc.Spec.LoadBalancerSourceRanges) > 0 {
+		return svc.Spec.LoadBalancerSourceRanges
+	}
+	var ranges []string
+	for _, cidr := range strings.Split(svc.Annotations[sourceRangesAnnotation], ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			ranges = append(ranges, cidr)
+		}
+	}
+	return ranges
+}
+
+// copyStringMap returns a copy of the map without the specified
+// keys, or nil if the resulting map is empty
+func copyStringMap(m map[string]string, skipKeys ...string) map[string]string {
+	var r map[string]string
+OUTER:
+	for k, v := range m {
+		for _, skipKey := range skipKeys {
+			if k == skipKey {
+				continue OUTER
+			}
+		}
+		if r == nil {
+			r = make(map[string]string)
+		}
+		r[k] = v
+	}
+	return r
+}
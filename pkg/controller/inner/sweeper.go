@@ -0,0 +1,320 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inner
+
+import (
+	"context"
+	"fmt"
+
+	"admiralty.io/multicluster-controller/pkg/controller"
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/finalizer"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+// NewSweeper returns a Sweeper that deletes the InnerServices of the
+// cluster which have no corresponding exposed inner services,
+// and makes the controller recreate the missing InnerServices. The
+// source and dest clients must read directly from the apiservers
+// rather than from the caches, as the sweeper runs before the caches
+// are synced.
+func NewSweeper(co *controller.Controller, sourceClusterName string, source, dest client.Client, targetNamespace string, opts Options, sweepOpts sweeper.Options) *sweeper.Sweeper {
+	r := &reconciler{
+		source:          source,
+		dest:            dest,
+		targetNamespace: targetNamespace,
+		clusterID:       opts.ClusterID,
+		exposeNodePorts: opts.ExposeNodePorts,
+	}
+	return sweeper.New("inner", sweepOpts, func(s *sweeper.Sweeper) error {
+		return r.sweep(s, func(nsn types.NamespacedName) {
+			co.Queue.Add(reconcile.Request{
+				Context:        sourceClusterName,
+				NamespacedName: nsn,
+			})
+		})
+	})
+}
+
+func (r *reconciler) sweep(s *sweeper.Sweeper, enqueue func(types.NamespacedName)) error {
+	// the InnerServices go first, see the sweeper package doc
+	var isvcs v1alpha1.InnerServiceList
+	listOpts := client.InNamespace(r.targetNamespace).MatchingLabels(map[string]string{
+		v1alpha1.ClusterLabel: r.clusterID,
+	})
+	if err := r.dest.List(context.TODO(), listOpts, &isvcs); err != nil {
+		return fmt.Errorf("error listing InnerServices: %v", err)
+	}
+
+	var svcs v1.ServiceList
+	if err := r.source.List(context.TODO(), &client.ListOptions{}, &svcs); err != nil {
+		return fmt.Errorf("error listing services: %v", err)
+	}
+
+	wanted := make(map[types.NamespacedName]bool)
+	for _, svc := range svcs.Items {
+		nsn := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+		if r.exposed(&svc) && svc.DeletionTimestamp == nil && !skipRx.MatchString(nsn.String()) {
+			wanted[nsn] = true
+		}
+	}
+
+	found := make(map[types.NamespacedName]bool)
+	for n := range isvcs.Items {
+		isvc := &isvcs.Items[n]
+		svcName := types.NamespacedName{
+			Namespace: isvc.Spec.ServiceNamespace,
+			Name:      isvc.Spec.ServiceName,
+		}
+		if wanted[svcName] && r.ownInnerService(isvc, svcName) && r.targetNamespacedName(svcName).Name == isvc.Name {
+			found[svcName] = true
+			continue
+		}
+		if isvc.DeletionTimestamp != nil {
+			// already being deleted
+			continue
+		}
+		if err := s.Delete("InnerService", isvc.Namespace+"/"+isvc.Name, func() error {
+			return r.dest.Delete(context.TODO(), isvc)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for nsn := range wanted {
+		if !found[nsn] {
+			nsn := nsn
+			s.Resync("InnerService", r.targetNamespacedName(nsn).String(), func() { enqueue(nsn) })
+		}
+	}
+
+	return nil
+}
+
+// NewImportSweeper returns a Sweeper that deletes the imported inner
+// services whose outer services are gone or no longer imported, and
+// makes the import controller recreate the missing ones. Like with
+// NewSweeper, the clients must read directly from the apiservers.
+func NewImportSweeper(co *controller.Controller, outerClusterName string, outer, inner client.Client, targetNamespace string, opts ImportOptions, sweepOpts sweeper.Options) *sweeper.Sweeper {
+	r := &importReconciler{
+		outer:            outer,
+		inner:            inner,
+		outerName:        outerClusterName,
+		targetNamespace:  targetNamespace,
+		defaultNamespace: opts.Namespace,
+	}
+	return sweeper.New("import", sweepOpts, func(s *sweeper.Sweeper) error {
+		return r.sweep(s, func(nsn types.NamespacedName) {
+			co.Queue.Add(reconcile.Request{
+				Context:        outerClusterName,
+				NamespacedName: nsn,
+			})
+		})
+	})
+}
+
+func (r *importReconciler) sweep(s *sweeper.Sweeper, enqueue func(types.NamespacedName)) error {
+	// the imported services go first, see the sweeper package doc
+	var importedSvcs v1.ServiceList
+	if err := r.inner.List(context.TODO(), &client.ListOptions{}, &importedSvcs); err != nil {
+		return fmt.Errorf("error listing inner services: %v", err)
+	}
+
+	var svcs v1.ServiceList
+	if err := r.outer.List(context.TODO(), client.InNamespace(r.targetNamespace), &svcs); err != nil {
+		return fmt.Errorf("error listing outer services: %v", err)
+	}
+
+	// wanted maps the names of the imported outer services to the
+	// inner namespaces
+	wanted := make(map[string]string)
+	for n := range svcs.Items {
+		svc := &svcs.Items[n]
+		if r.imported(svc) {
+			wanted[svc.Name] = r.importedNamespace(svc)
+		}
+	}
+
+	found := make(map[string]bool)
+	for n := range importedSvcs.Items {
+		svc := &importedSvcs.Items[n]
+		name, ok := svc.Labels[importedFromLabel]
+		if !ok {
+			continue
+		}
+		if ns, ok := wanted[name]; ok && ns == svc.Namespace && name == svc.Name {
+			found[name] = true
+			continue
+		}
+		if svc.DeletionTimestamp != nil {
+			continue
+		}
+		if err := s.Delete("Service", svc.Namespace+"/"+svc.Name, func() error {
+			return r.inner.Delete(context.TODO(), svc)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for name, ns := range wanted {
+		if !found[name] {
+			nsn := types.NamespacedName{Namespace: r.targetNamespace, Name: name}
+			s.Resync("Service", ns+"/"+name, func() { enqueue(nsn) })
+		}
+	}
+
+	return nil
+}
+
+// NewIngressSweeper returns a Sweeper that deletes the InnerIngresses
+// of the cluster which have no corresponding mirrored inner
+// Ingresses, and makes the ingress controller recreate the missing
+// ones. If co is nil, which means that the Ingresses are no longer
+// mirrored, it deletes the InnerIngresses of the Ingresses that
+// still have the finalizer and removes the finalizer once they're
+// gone, so that the Ingresses can be deleted. Like with NewSweeper,
+// the clients must read directly from the apiservers.
+func NewIngressSweeper(co *controller.Controller, sourceClusterName string, source, dest client.Client, targetNamespace string, opts IngressOptions, sweepOpts sweeper.Options) *sweeper.Sweeper {
+	r := &ingressReconciler{
+		reconciler: &reconciler{
+			source:          source,
+			dest:            dest,
+			sourceName:      sourceClusterName,
+			targetNamespace: targetNamespace,
+			clusterID:       opts.ClusterID,
+		},
+		ingressClass: opts.IngressClass,
+	}
+	return sweeper.New("ingress", sweepOpts, func(s *sweeper.Sweeper) error {
+		if co == nil {
+			return r.sweepUnmirrored(s)
+		}
+		return r.sweep(s, func(nsn types.NamespacedName) {
+			co.Queue.Add(reconcile.Request{
+				Context:        sourceClusterName,
+				NamespacedName: nsn,
+			})
+		})
+	})
+}
+
+func (r *ingressReconciler) sweep(s *sweeper.Sweeper, enqueue func(types.NamespacedName)) error {
+	// the InnerIngresses go first, see the sweeper package doc
+	var iings v1alpha1.InnerIngressList
+	listOpts := client.InNamespace(r.targetNamespace).MatchingLabels(map[string]string{
+		v1alpha1.ClusterLabel: r.clusterID,
+	})
+	if err := r.dest.List(context.TODO(), listOpts, &iings); err != nil {
+		return fmt.Errorf("error listing InnerIngresses: %v", err)
+	}
+
+	var ings extv1beta1.IngressList
+	if err := r.source.List(context.TODO(), &client.ListOptions{}, &ings); err != nil {
+		return fmt.Errorf("error listing ingresses: %v", err)
+	}
+
+	wanted := make(map[types.NamespacedName]bool)
+	for n := range ings.Items {
+		ing := &ings.Items[n]
+		if ing.DeletionTimestamp == nil && r.mirrored(ing) {
+			wanted[types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}] = true
+		}
+	}
+
+	found := make(map[types.NamespacedName]bool)
+	for n := range iings.Items {
+		iing := &iings.Items[n]
+		ingName := types.NamespacedName{
+			Namespace: iing.Spec.IngressNamespace,
+			Name:      iing.Spec.IngressName,
+		}
+		if wanted[ingName] && r.ownInnerIngress(iing, ingName) && r.ingressNamespacedName(ingName).Name == iing.Name {
+			found[ingName] = true
+			continue
+		}
+		if iing.DeletionTimestamp != nil {
+			// already being deleted
+			continue
+		}
+		if err := s.Delete("InnerIngress", iing.Namespace+"/"+iing.Name, func() error {
+			return r.dest.Delete(context.TODO(), iing)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for nsn := range wanted {
+		if !found[nsn] {
+			nsn := nsn
+			s.Resync("InnerIngress", r.ingressNamespacedName(nsn).String(), func() { enqueue(nsn) })
+		}
+	}
+
+	return nil
+}
+
+// sweepUnmirrored cleans up after the ingress controller once the
+// Ingresses are no longer mirrored. The InnerIngresses are only
+// looked up for the Ingresses that have the finalizer, so nothing
+// is done if the ingress controller was never used.
+func (r *ingressReconciler) sweepUnmirrored(s *sweeper.Sweeper) error {
+	var ings extv1beta1.IngressList
+	if err := r.source.List(context.TODO(), &client.ListOptions{}, &ings); err != nil {
+		return fmt.Errorf("error listing ingresses: %v", err)
+	}
+	for n := range ings.Items {
+		ing := &ings.Items[n]
+		if !finalizer.Has(ing, innerFinalizer) {
+			continue
+		}
+		ingName := types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}
+		nsn := r.ingressNamespacedName(ingName)
+		iing := &v1alpha1.InnerIngress{}
+		err := r.dest.Get(context.TODO(), nsn, iing)
+		switch {
+		case errors.IsNotFound(err):
+			// all good
+		case err != nil:
+			return fmt.Errorf("error getting InnerIngress %s: %v", nsn, err)
+		case r.ownInnerIngress(iing, ingName):
+			if iing.DeletionTimestamp == nil {
+				if err := s.Delete("InnerIngress", nsn.String(), func() error {
+					return r.dest.Delete(context.TODO(), iing)
+				}); err != nil {
+					return err
+				}
+			}
+			// the finalizer is removed by one of the next
+			// sweeps once the InnerIngress is gone
+			continue
+		}
+		klog.V(1).Infof("removing finalizer from ingress %s", ingName)
+		finalizer.Remove(ing, innerFinalizer)
+		if err := r.source.Update(context.TODO(), ing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+// makeEndpoints makes Endpoints for the outer service which point
+// to the VM pods that correspond to the nodes of the InnerService.
+// pods maps the inner node names to the VM pods, see locatePods.
+func (r *reconciler) makeEndpoints(isvc *v1alpha1.InnerService, pods map[string]*v1.Pod) *v1.Endpoints {
+	var ports []v1.EndpointPort
+	for _, p := range isvc.Spec.Ports {
+		ports = append(ports, v1.EndpointPort{
+			Name:     p.Name,
+			Protocol: p.Protocol,
+			Port:     p.NodePort,
+		})
+	}
+
+	var addrs, notReadyAddrs []v1.EndpointAddress
+	for _, node := range nodes(isvc) {
+		pod := pods[node.Name]
+		if pod == nil || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			klog.V(1).Infof("no usable VM pod for node %q", node.Name)
+			continue
+		}
+		addr := v1.EndpointAddress{
+			IP: pod.Status.PodIP,
+			TargetRef: &v1.ObjectReference{
+				Kind:      "Pod",
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				UID:       pod.UID,
+			},
+		}
+		if pod.Spec.NodeName != "" {
+			nodeName := pod.Spec.NodeName
+			addr.NodeName = &nodeName
+		}
+		if podReady(pod) {
+			addrs = append(addrs, addr)
+		} else {
+			notReadyAddrs = append(notReadyAddrs, addr)
+		}
+	}
+	if isvc.Spec.HealthCheckNodePort != 0 && len(addrs) > 0 {
+		addrs, notReadyAddrs = r.checkAddresses(addrs, notReadyAddrs, isvc.Spec.HealthCheckNodePort)
+	}
+	sortAddresses(addrs)
+	sortAddresses(notReadyAddrs)
+
+	var subsets []v1.EndpointSubset
+	if len(ports) > 0 && (len(addrs) > 0 || len(notReadyAddrs) > 0) {
+		subsets = []v1.EndpointSubset{
+			{
+				Addresses:         addrs,
+				NotReadyAddresses: notReadyAddrs,
+				Ports:             ports,
+			},
+		}
+	}
+
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.targetNamespace,
+			Name:      isvc.Name,
+			Labels:    clusterLabels(isvc),
+		},
+		Subsets: subsets,
+	}
+}
+
+// locatePods returns a map from the names of the InnerService's
+// nodes to the VM pods. The nodes that have no VM pods are omitted.
+func (r *reconciler) locatePods(isvc *v1alpha1.InnerService) (map[string]*v1.Pod, error) {
+	pods := make(map[string]*v1.Pod)
+	for _, node := range nodes(isvc) {
+		pod, err := r.locator.Locate(node)
+		if err != nil {
+			return nil, fmt.Errorf("error locating the VM pod for node %q: %v", node.Name, err)
+		}
+		if pod != nil {
+			pods[node.Name] = pod
+		}
+	}
+	return pods, nil
+}
+
+// nodes returns the details of the InnerService's nodes. The
+// InnerServices made by older versions of the inner controller only
+// have the node names.
+func nodes(isvc *v1alpha1.InnerService) []v1alpha1.InnerServiceNode {
+	if len(isvc.Spec.Nodes) != 0 {
+		return isvc.Spec.Nodes
+	}
+	var nodes []v1alpha1.InnerServiceNode
+	for _, name := range isvc.Spec.NodeNames {
+		nodes = append(nodes, v1alpha1.InnerServiceNode{Name: name})
+	}
+	return nodes
+}
+
+// checkAddresses probes the ready addresses on the specified health
+// check port and moves the ones that fail the check to the not ready
+// addresses, so they no longer receive the traffic
+func (r *reconciler) checkAddresses(addrs, notReadyAddrs []v1.EndpointAddress, port int32) ([]v1.EndpointAddress, []v1.EndpointAddress) {
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	healthy := r.healthChecker.check(ips, port)
+	var passed []v1.EndpointAddress
+	for _, addr := range addrs {
+		if healthy[addr.IP] {
+			passed = append(passed, addr)
+		} else {
+			notReadyAddrs = append(notReadyAddrs, addr)
+		}
+	}
+	return passed, notReadyAddrs
+}
+
+// syncEndpoints creates the specified Endpoints object or updates
+// the existing one if its subsets don't match
+func (r *reconciler) syncEndpoints(ep *v1.Endpoints) error {
+	curEp := &v1.Endpoints{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}, curEp); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("creating endpoints %s/%s", ep.Namespace, ep.Name)
+			return r.client.Create(context.TODO(), ep)
+		}
+		return err
+	}
+
+	if reflect.DeepEqual(curEp.Subsets, ep.Subsets) && reflect.DeepEqual(curEp.Labels, ep.Labels) {
+		return nil
+	}
+
+	klog.V(1).Infof("endpoints mismatch! WAS:\n%s\n\nNOW:\n%s\n", ToJSON(curEp.Subsets), ToJSON(ep.Subsets))
+	curEp.Labels = ep.Labels
+	curEp.Subsets = ep.Subsets
+	return r.client.Update(context.TODO(), curEp)
+}
+
+func (r *reconciler) deleteEndpoints(nsn types.NamespacedName) error {
+	ep := &v1.Endpoints{}
+	if err := r.client.Get(context.TODO(), nsn, ep); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !managed(ep) || ingressObject(ep) {
+		return nil
+	}
+	if err := r.client.Delete(context.TODO(), ep); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// innerServicesForPod returns reconcile requests for the
+// InnerServices which have the node that corresponds to the pod
+// among their nodes
+func (r *reconciler) innerServicesForPod(obj interface{}) []reconcile.Request {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Namespace != r.targetNamespace {
+		return nil
+	}
+
+	var isvcs v1alpha1.InnerServiceList
+	if err := r.client.List(context.TODO(), &client.ListOptions{}, &isvcs); err != nil {
+		klog.Warningf("error listing InnerServices: %v", err)
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, isvc := range isvcs.Items {
+		for _, node := range nodes(&isvc) {
+			if r.locator.Matches(pod, node) {
+				reqs = append(reqs, reconcile.Request{
+					Context: r.clusterName,
+					NamespacedName: types.NamespacedName{
+						Namespace: isvc.Namespace,
+						Name:      isvc.Name,
+					},
+				})
+				break
+			}
+		}
+	}
+	return reqs
+}
+
+func podReady(pod *v1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func sortAddresses(addrs []v1.EndpointAddress) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].IP < addrs[j].IP
+	})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// healthCheckInterval specifies how often the inner nodes are
+	// probed for the services which have healthCheckNodePort set
+	healthCheckInterval = 10 * time.Second
+	// healthCheckTimeout is the timeout for a single probe
+	healthCheckTimeout = 2 * time.Second
+)
+
+// healthChecker probes inner nodes on the healthCheckNodePort of
+// the inner service. kube-proxy of the inner node responds on that
+// port with 200 if the node has local endpoints for the service
+// and with 503 otherwise.
+type healthChecker struct {
+	client *http.Client
+}
+
+func newHealthChecker(timeout time.Duration) *healthChecker {
+	return &healthChecker{
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// check probes the specified IPs concurrently and returns the set
+// of the ones which passed the health check
+func (hc *healthChecker) check(ips []string, port int32) map[string]bool {
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	healthy := make(map[string]bool)
+	for _, ip := range ips {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			if err := hc.probe(ip, port); err != nil {
+				klog.V(1).Infof("health check failed for %s:%d: %v", ip, port, err)
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			healthy[ip] = true
+		}(ip)
+	}
+	wg.Wait()
+	return healthy
+}
+
+func (hc *healthChecker) probe(ip string, port int32) error {
+	url := fmt.Sprintf("http://%s/healthz", net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	resp, err := hc.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+// startHealthServer starts an HTTP server that responds with the
+// specified status code on ip:port. port 0 means any free port.
+func startHealthServer(t *testing.T, ip string, port int, code int) (*httptest.Server, int) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("can't listen on %s:%d: %v", ip, port, err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	s.Listener = l
+	s.Start()
+	return s, l.Addr().(*net.TCPAddr).Port
+}
+
+func readyPod(name, ip string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+		},
+		Status: v1.PodStatus{
+			PodIP: ip,
+			Conditions: []v1.PodCondition{
+				{Type: v1.PodReady, Status: v1.ConditionTrue},
+			},
+		},
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// kube-proxy of the first node has local endpoints for the
+	// service, the second one doesn't
+	healthy, port := startHealthServer(t, "127.0.0.1", 0, http.StatusOK)
+	defer healthy.Close()
+	unhealthy, _ := startHealthServer(t, "127.0.0.2", port, http.StatusServiceUnavailable)
+	defer unhealthy.Close()
+
+	r := &reconciler{
+		targetNamespace: "default",
+		healthChecker:   newHealthChecker(healthCheckTimeout),
+	}
+	isvc := &v1alpha1.InnerService{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "k8s-default-foo",
+		},
+		Spec: v1alpha1.InnerServiceSpec{
+			ClusterID: "k8s",
+			Ports: []v1alpha1.InnerServicePort{
+				{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+			},
+			NodeNames:             []string{"k8s-0", "k8s-1", "k8s-2"},
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+			HealthCheckNodePort:   int32(port),
+		},
+	}
+	pods := map[string]*v1.Pod{
+		"k8s-0": readyPod("k8s-0", "127.0.0.1"),
+		"k8s-1": readyPod("k8s-1", "127.0.0.2"),
+		// nothing listens there
+		"k8s-2": readyPod("k8s-2", "127.0.0.3"),
+	}
+
+	ep := r.makeEndpoints(isvc, pods)
+	g.Expect(ep.Subsets).To(gomega.HaveLen(1))
+	var ready, notReady []string
+	for _, addr := range ep.Subsets[0].Addresses {
+		ready = append(ready, addr.IP)
+	}
+	for _, addr := range ep.Subsets[0].NotReadyAddresses {
+		notReady = append(notReady, addr.IP)
+	}
+	g.Expect(ready).To(gomega.Equal([]string{"127.0.0.1"}))
+	g.Expect(notReady).To(gomega.Equal([]string{"127.0.0.2", "127.0.0.3"}))
+
+	// without the health check port, all the ready pods are used
+	isvc.Spec.HealthCheckNodePort = 0
+	ep = r.makeEndpoints(isvc, pods)
+	g.Expect(ep.Subsets[0].Addresses).To(gomega.HaveLen(3))
+	g.Expect(ep.Subsets[0].NotReadyAddresses).To(gomega.BeEmpty())
+}
@@ -0,0 +1,437 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"admiralty.io/multicluster-controller/pkg/cluster"
+	"admiralty.io/multicluster-controller/pkg/controller"
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"admiralty.io/multicluster-controller/pkg/reference"
+	"k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis"
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/finalizer"
+	"github.com/ivan4th/virtletlb/pkg/handler"
+)
+
+const (
+	// ingressClassAnnotation selects the outer ingress controller
+	// that serves the outer ingresses
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+	// ingressPortName and ingressPort specify the port of the
+	// outer services made for the InnerIngresses
+	ingressPortName = "http"
+	ingressPort     = 80
+)
+
+// NewIngressController returns a controller that makes outer
+// Ingresses for the InnerIngresses. Each outer Ingress routes the
+// requests to a selectorless service whose Endpoints point to the
+// node port of the inner ingress controller on the VM pods.
+func NewIngressController(cluster *cluster.Cluster, targetNamespace string, opts Options) (*controller.Controller, error) {
+	klog.V(1).Infof("*** starting ingress watch ***")
+	client, err := cluster.GetDelegatingClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting delegating client for source cluster: %v", err)
+	}
+
+	backend, nodeLocator, err := newLocator(client, targetNamespace, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ingressReconciler{
+		reconciler: &reconciler{
+			client:          client,
+			backend:         backend,
+			locator:         nodeLocator,
+			clusterName:     cluster.GetClusterName(),
+			targetNamespace: targetNamespace,
+		},
+		ingressClass: opts.IngressClass,
+	}
+	co := controller.New(r, controller.Options{})
+
+	if err := apis.AddToScheme(cluster.GetScheme()); err != nil {
+		return nil, fmt.Errorf("adding APIs to dest cluster's scheme: %v", err)
+	}
+	if err := co.WatchResourceReconcileObject(cluster, &v1alpha1.InnerIngress{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up InnerIngress watch in the cluster: %v", err)
+	}
+	// the outer ingresses are mapped back to their InnerIngresses
+	// so that the load balancer status is propagated
+	if err := co.WatchResourceReconcileController(cluster, &extv1beta1.Ingress{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up Ingress watch in the cluster: %v", err)
+	}
+	if err := cluster.AddEventHandler(&v1.Pod{}, &handler.EnqueueRequestsFromMapFunc{
+		Queue:      co.Queue,
+		ToRequests: r.innerIngressesForPod,
+	}); err != nil {
+		return nil, fmt.Errorf("setting up Pod watch in the cluster: %v", err)
+	}
+
+	klog.V(1).Infof("*** ingress watch started ***")
+
+	return co, nil
+}
+
+type ingressReconciler struct {
+	*reconciler
+	ingressClass string
+}
+
+func (r *ingressReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	reqName := req.NamespacedName.String()
+	klog.V(1).Infof("*** outer ingress watch: %v ***", reqName)
+	iing := &v1alpha1.InnerIngress{}
+	if err := r.client.Get(context.TODO(), req.NamespacedName, iing); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("no InnerIngress for %v; deleting outer ingress, if it exists", reqName)
+			_, err := r.deleteIngressObjects(r.targetNamespacedName(req.NamespacedName))
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{}, err
+	}
+
+	if iing.DeletionTimestamp != nil {
+		klog.V(1).Infof("InnerIngress %v is being deleted", reqName)
+		return r.finalizeInnerIngress(iing)
+	}
+
+	if finalizer.Add(iing, outerFinalizer) {
+		klog.V(1).Infof("adding finalizer to InnerIngress %v", reqName)
+		if err := r.client.Update(context.TODO(), iing); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	ownerRef := reference.NewMulticlusterOwnerReference(iing, iing.GroupVersionKind(), req.Context)
+	isvc := backendService(iing)
+	svc := r.makeIngressService(iing)
+	reference.SetMulticlusterControllerReference(svc, ownerRef)
+	pods, err := r.locatePods(isvc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	ep := r.makeEndpoints(isvc, pods)
+	ep.Labels = ingressLabels(iing)
+	reference.SetMulticlusterControllerReference(ep, ownerRef)
+	ing := r.makeIngress(iing)
+	reference.SetMulticlusterControllerReference(ing, ownerRef)
+
+	if err := r.syncIngressService(svc); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := r.syncEndpoints(ep); err != nil {
+		return reconcile.Result{}, err
+	}
+	curIng, err := r.syncIngress(ing)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	status := iing.Status.DeepCopy()
+	status.LoadBalancer = *curIng.Status.LoadBalancer.DeepCopy()
+	status.ObservedGeneration = iing.Generation
+	if reflect.DeepEqual(&iing.Status, status) {
+		return reconcile.Result{}, nil
+	}
+	klog.V(1).Infof("outer: updating InnerIngress status:\n%s", ToJSON(status))
+	iing.Status = *status
+	return reconcile.Result{}, r.client.Status().Update(context.TODO(), iing)
+}
+
+// backendService returns an InnerService that describes the node
+// port of the inner ingress controller, so that the Endpoints of
+// the outer service can be made the same way as for the
+// InnerServices
+func backendService(iing *v1alpha1.InnerIngress) *v1alpha1.InnerService {
+	return &v1alpha1.InnerService{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: iing.Namespace,
+			Name:      iing.Name,
+		},
+		Spec: v1alpha1.InnerServiceSpec{
+			ClusterID: iing.Spec.ClusterID,
+			Ports: []v1alpha1.InnerServicePort{
+				{
+					Name:     ingressPortName,
+					Protocol: v1.ProtocolTCP,
+					Port:     ingressPort,
+					NodePort: iing.Spec.NodePort,
+				},
+			},
+			NodeNames: iing.Spec.NodeNames,
+			Nodes:     iing.Spec.Nodes,
+		},
+	}
+}
+
+// ingressLabels returns the labels of the outer objects made for the
+// InnerIngress
+func ingressLabels(iing *v1alpha1.InnerIngress) map[string]string {
+	return map[string]string{
+		v1alpha1.ClusterLabel:      iing.Spec.ClusterID,
+		v1alpha1.InnerIngressLabel: iing.Name,
+	}
+}
+
+// ingressObject returns true if the object was made for some
+// InnerIngress
+func ingressObject(obj metav1.Object) bool {
+	_, found := obj.GetLabels()[v1alpha1.InnerIngressLabel]
+	return found
+}
+
+// ownIngressObject returns true if the object was made for the
+// InnerIngress with the specified name
+func ownIngressObject(obj metav1.Object, iingName string) bool {
+	return managed(obj) && obj.GetLabels()[v1alpha1.InnerIngressLabel] == iingName
+}
+
+// makeIngressService makes a ClusterIP service for the outer
+// Ingress. Its Endpoints are managed by the controller.
+func (r *ingressReconciler) makeIngressService(iing *v1alpha1.InnerIngress) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.targetNamespace,
+			Name:      iing.Name,
+			Labels:    ingressLabels(iing),
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeClusterIP,
+			Ports: []v1.ServicePort{
+				{
+					Name:       ingressPortName,
+					Protocol:   v1.ProtocolTCP,
+					Port:       ingressPort,
+					TargetPort: intstr.FromInt(int(iing.Spec.NodePort)),
+				},
+			},
+			SessionAffinity: v1.ServiceAffinityNone,
+		},
+	}
+}
+
+// makeIngress makes an outer Ingress that routes the requests
+// matching the InnerIngress rules to the outer service
+func (r *ingressReconciler) makeIngress(iing *v1alpha1.InnerIngress) *extv1beta1.Ingress {
+	backend := extv1beta1.IngressBackend{
+		ServiceName: iing.Name,
+		ServicePort: intstr.FromInt(ingressPort),
+	}
+	var rules []extv1beta1.IngressRule
+	for _, rule := range iing.Spec.Rules {
+		var paths []extv1beta1.HTTPIngressPath
+		for _, p := range rule.Paths {
+			paths = append(paths, extv1beta1.HTTPIngressPath{Path: p, Backend: backend})
+		}
+		if len(paths) == 0 {
+			paths = []extv1beta1.HTTPIngressPath{{Backend: backend}}
+		}
+		rules = append(rules, extv1beta1.IngressRule{
+			Host: rule.Host,
+			IngressRuleValue: extv1beta1.IngressRuleValue{
+				HTTP: &extv1beta1.HTTPIngressRuleValue{Paths: paths},
+			},
+		})
+	}
+
+	ing := &extv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.targetNamespace,
+			Name:      iing.Name,
+			Labels:    ingressLabels(iing),
+		},
+		Spec: extv1beta1.IngressSpec{
+			Rules: rules,
+		},
+	}
+	if r.ingressClass != "" {
+		ing.Annotations = map[string]string{
+			ingressClassAnnotation: r.ingressClass,
+		}
+	}
+	return ing
+}
+
+// syncIngressService creates the outer service for the InnerIngress
+// or updates the existing one if its ports don't match
+func (r *ingressReconciler) syncIngressService(svc *v1.Service) error {
+	curSvc := &v1.Service{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}, curSvc); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("creating ingress service %s/%s", svc.Namespace, svc.Name)
+			return r.client.Create(context.TODO(), svc)
+		}
+		return err
+	}
+	if !ownIngressObject(curSvc, svc.Name) {
+		return fmt.Errorf("service %s/%s already exists and doesn't belong to InnerIngress %s", curSvc.Namespace, curSvc.Name, svc.Name)
+	}
+	if reflect.DeepEqual(curSvc.Spec.Ports, svc.Spec.Ports) && reflect.DeepEqual(curSvc.Labels, svc.Labels) {
+		return nil
+	}
+	klog.V(1).Infof("updating ingress service %s/%s", svc.Namespace, svc.Name)
+	curSvc.Labels = svc.Labels
+	curSvc.Spec.Ports = svc.Spec.Ports
+	return r.client.Update(context.TODO(), curSvc)
+}
+
+// syncIngress creates the outer Ingress or updates the existing one
+// if it doesn't match. It returns the current Ingress.
+func (r *ingressReconciler) syncIngress(ing *extv1beta1.Ingress) (*extv1beta1.Ingress, error) {
+	curIng := &extv1beta1.Ingress{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}, curIng); err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(1).Infof("creating ingress %s/%s", ing.Namespace, ing.Name)
+			return ing, r.client.Create(context.TODO(), ing)
+		}
+		return nil, err
+	}
+	if !ownIngressObject(curIng, ing.Name) {
+		return nil, fmt.Errorf("ingress %s/%s already exists and doesn't belong to InnerIngress %s", curIng.Namespace, curIng.Name, ing.Name)
+	}
+	if reflect.DeepEqual(curIng.Spec, ing.Spec) && reflect.DeepEqual(curIng.Labels, ing.Labels) &&
+		curIng.Annotations[ingressClassAnnotation] == ing.Annotations[ingressClassAnnotation] {
+		return curIng, nil
+	}
+	klog.V(1).Infof("updating ingress %s/%s", ing.Namespace, ing.Name)
+	curIng.Labels = ing.Labels
+	curIng.Spec = ing.Spec
+	if r.ingressClass != "" {
+		if curIng.Annotations == nil {
+			curIng.Annotations = make(map[string]string)
+		}
+		curIng.Annotations[ingressClassAnnotation] = r.ingressClass
+	} else {
+		delete(curIng.Annotations, ingressClassAnnotation)
+	}
+	return curIng, r.client.Update(context.TODO(), curIng)
+}
+
+// finalizeInnerIngress deletes the outer objects of the InnerIngress
+// that's being deleted. Once they're gone, it removes the finalizer
+// from the InnerIngress.
+func (r *ingressReconciler) finalizeInnerIngress(iing *v1alpha1.InnerIngress) (reconcile.Result, error) {
+	nsn := r.targetNamespacedName(types.NamespacedName{Namespace: iing.Namespace, Name: iing.Name})
+	gone, err := r.deleteIngressObjects(nsn)
+	switch {
+	case err != nil:
+		return reconcile.Result{}, err
+	case !gone:
+		klog.V(1).Infof("waiting for ingress %s to be deleted", nsn)
+		return reconcile.Result{RequeueAfter: finalizerRequeueInterval}, nil
+	case !finalizer.Has(iing, outerFinalizer):
+		return reconcile.Result{}, nil
+	}
+
+	klog.V(1).Infof("removing finalizer from InnerIngress %s/%s", iing.Namespace, iing.Name)
+	finalizer.Remove(iing, outerFinalizer)
+	return reconcile.Result{}, r.client.Update(context.TODO(), iing)
+}
+
+// deleteIngressObjects deletes the outer Ingress, service and
+// Endpoints made for the InnerIngress. It returns true if the
+// Ingress and the service are gone.
+func (r *reconciler) deleteIngressObjects(nsn types.NamespacedName) (bool, error) {
+	gone := true
+	for _, obj := range []interface {
+		metav1.Object
+		runtime.Object
+	}{&extv1beta1.Ingress{}, &v1.Service{}} {
+		if err := r.client.Get(context.TODO(), nsn, obj); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if !ownIngressObject(obj, nsn.Name) {
+			continue
+		}
+		gone = false
+		if obj.GetDeletionTimestamp() == nil {
+			if err := r.client.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) {
+				return false, err
+			}
+		}
+	}
+	if !gone {
+		return false, nil
+	}
+
+	ep := &v1.Endpoints{}
+	if err := r.client.Get(context.TODO(), nsn, ep); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if !ownIngressObject(ep, nsn.Name) {
+		return true, nil
+	}
+	if err := r.client.Delete(context.TODO(), ep); err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// innerIngressesForPod returns reconcile requests for the
+// InnerIngresses which have the node that corresponds to the pod
+// among their nodes
+func (r *ingressReconciler) innerIngressesForPod(obj interface{}) []reconcile.Request {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Namespace != r.targetNamespace {
+		return nil
+	}
+
+	var iings v1alpha1.InnerIngressList
+	if err := r.client.List(context.TODO(), &client.ListOptions{}, &iings); err != nil {
+		klog.Warningf("error listing InnerIngresses: %v", err)
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, iing := range iings.Items {
+		for _, node := range nodes(backendService(&iing)) {
+			if r.locator.Matches(pod, node) {
+				reqs = append(reqs, reconcile.Request{
+					Context: r.clusterName,
+					NamespacedName: types.NamespacedName{
+						Namespace: iing.Namespace,
+						Name:      iing.Name,
+					},
+				})
+				break
+			}
+		}
+	}
+	return reqs
+}
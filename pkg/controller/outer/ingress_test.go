@@ -0,0 +1,93 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+func TestMakeIngress(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := &ingressReconciler{
+		reconciler:   &reconciler{targetNamespace: "default"},
+		ingressClass: "nginx",
+	}
+	iing := &v1alpha1.InnerIngress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "k8s-default-foo-ingress-0123456789",
+		},
+		Spec: v1alpha1.InnerIngressSpec{
+			ClusterID:        "k8s",
+			IngressNamespace: "default",
+			IngressName:      "foo",
+			Rules: []v1alpha1.InnerIngressRule{
+				{Host: "foo.example.com", Paths: []string{"/a", "/b"}},
+				{Host: "bar.example.com"},
+			},
+			NodePort: 30080,
+		},
+	}
+
+	svc := r.makeIngressService(iing)
+	g.Expect(svc.Name).To(gomega.Equal(iing.Name))
+	g.Expect(svc.Labels).To(gomega.Equal(ingressLabels(iing)))
+	g.Expect(svc.Spec.Ports).To(gomega.HaveLen(1))
+	g.Expect(svc.Spec.Ports[0].TargetPort).To(gomega.Equal(intstr.FromInt(30080)))
+
+	backend := extv1beta1.IngressBackend{
+		ServiceName: iing.Name,
+		ServicePort: intstr.FromInt(ingressPort),
+	}
+	ing := r.makeIngress(iing)
+	g.Expect(ing.Name).To(gomega.Equal(iing.Name))
+	g.Expect(ing.Annotations).To(gomega.HaveKeyWithValue(ingressClassAnnotation, "nginx"))
+	g.Expect(ownIngressObject(ing, iing.Name)).To(gomega.BeTrue())
+	g.Expect(ing.Spec.Rules).To(gomega.Equal([]extv1beta1.IngressRule{
+		{
+			Host: "foo.example.com",
+			IngressRuleValue: extv1beta1.IngressRuleValue{
+				HTTP: &extv1beta1.HTTPIngressRuleValue{
+					Paths: []extv1beta1.HTTPIngressPath{
+						{Path: "/a", Backend: backend},
+						{Path: "/b", Backend: backend},
+					},
+				},
+			},
+		},
+		{
+			// the rules without paths route all the requests
+			// for the host
+			Host: "bar.example.com",
+			IngressRuleValue: extv1beta1.IngressRuleValue{
+				HTTP: &extv1beta1.HTTPIngressRuleValue{
+					Paths: []extv1beta1.HTTPIngressPath{{Backend: backend}},
+				},
+			},
+		},
+	}))
+
+	r.ingressClass = ""
+	g.Expect(r.makeIngress(iing).Annotations).To(gomega.BeEmpty())
+}
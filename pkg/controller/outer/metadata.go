@@ -0,0 +1,165 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/keyfilter"
+)
+
+const (
+	// managedAnnotationsAnnotation and managedLabelsAnnotation
+	// hold the comma-separated lists of the annotation and label
+	// keys of the outer service that were copied from the inner
+	// service, so they can be removed when they disappear from
+	// the inner service
+	managedAnnotationsAnnotation = "virtletlb.virtlet.cloud/managed-annotations"
+	managedLabelsAnnotation      = "virtletlb.virtlet.cloud/managed-labels"
+	// innerNamespaceAnnotation and innerNameAnnotation hold the
+	// namespace and the name of the inner service, as the name of
+	// the outer service may be shortened
+	innerNamespaceAnnotation = "virtletlb.virtlet.cloud/inner-namespace"
+	innerNameAnnotation      = "virtletlb.virtlet.cloud/inner-name"
+)
+
+// reservedKeyPrefix is the prefix of the keys that are set by the
+// controllers themselves and thus are never copied from the inner
+// services
+var reservedKeyPrefix = v1alpha1.SchemeGroupVersion.Group + "/"
+
+// clusterLabels returns the labels that mark the outer objects
+// as belonging to the inner cluster of the InnerService
+func clusterLabels(isvc *v1alpha1.InnerService) map[string]string {
+	return map[string]string{
+		v1alpha1.ClusterLabel: isvc.Spec.ClusterID,
+	}
+}
+
+// originAnnotations returns the annotations that point to the inner
+// service of the InnerService
+func originAnnotations(isvc *v1alpha1.InnerService) map[string]string {
+	if isvc.Spec.ServiceName == "" {
+		return nil
+	}
+	return map[string]string{
+		innerNamespaceAnnotation: isvc.Spec.ServiceNamespace,
+		innerNameAnnotation:      isvc.Spec.ServiceName,
+	}
+}
+
+// applyOriginAnnotations sets the annotations that point to the
+// inner service of the InnerService. It returns true if the
+// annotations have changed.
+func applyOriginAnnotations(svc *v1.Service, isvc *v1alpha1.InnerService) bool {
+	changed := false
+	for k, v := range originAnnotations(isvc) {
+		if svc.Annotations[k] != v {
+			if svc.Annotations == nil {
+				svc.Annotations = make(map[string]string)
+			}
+			svc.Annotations[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// belongsToCluster returns true if the object is managed by the
+// controller on behalf of the specified inner cluster
+func belongsToCluster(obj metav1.Object, clusterID string) bool {
+	value, found := obj.GetLabels()[v1alpha1.ClusterLabel]
+	return found && value == clusterID
+}
+
+// managed returns true if the object is managed by the controller
+// on behalf of some inner cluster
+func managed(obj metav1.Object) bool {
+	_, found := obj.GetLabels()[v1alpha1.ClusterLabel]
+	return found
+}
+
+// applyPassthroughMetadata copies the labels and annotations of the
+// InnerService that are allowed by the filters to the outer service,
+// removing the previously copied ones that are no longer present.
+// It returns true if the service's metadata has changed.
+func (r *reconciler) applyPassthroughMetadata(svc *v1.Service, isvc *v1alpha1.InnerService) bool {
+	if svc.Labels == nil {
+		svc.Labels = make(map[string]string)
+	}
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	labelsChanged := syncManagedKeys(svc.Labels, filterKeys(r.labelFilter, isvc.Spec.Labels), svc.Annotations, managedLabelsAnnotation)
+	annotationsChanged := syncManagedKeys(svc.Annotations, filterKeys(r.annotationFilter, isvc.Spec.Annotations), svc.Annotations, managedAnnotationsAnnotation)
+	return labelsChanged || annotationsChanged
+}
+
+func filterKeys(f *keyfilter.Filter, m map[string]string) map[string]string {
+	r := f.Apply(m)
+	for k := range r {
+		if strings.HasPrefix(k, reservedKeyPrefix) {
+			delete(r, k)
+		}
+	}
+	return r
+}
+
+// syncManagedKeys makes the entries of target that are managed by
+// the controller match desired ones. The list of managed keys is
+// kept in annotations under recordKey.
+func syncManagedKeys(target, desired, annotations map[string]string, recordKey string) bool {
+	changed := false
+	for _, k := range strings.Split(annotations[recordKey], ",") {
+		if k == "" {
+			continue
+		}
+		if _, found := desired[k]; found {
+			continue
+		}
+		if _, found := target[k]; found {
+			delete(target, k)
+			changed = true
+		}
+	}
+
+	var keys []string
+	for k, v := range desired {
+		if cur, found := target[k]; !found || cur != v {
+			target[k] = v
+			changed = true
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	record := strings.Join(keys, ",")
+	if annotations[recordKey] != record {
+		if record == "" {
+			delete(annotations, recordKey)
+		} else {
+			annotations[recordKey] = record
+		}
+		changed = true
+	}
+	return changed
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+func (r *reconciler) needsNetworkPolicy(isvc *v1alpha1.InnerService) bool {
+	return r.networkPolicies && len(isvc.Spec.LoadBalancerSourceRanges) > 0
+}
+
+// makeNetworkPolicy makes a NetworkPolicy that only allows the
+// traffic from the InnerService's loadBalancerSourceRanges to reach
+// the node ports of the VM pods, see locatePods. The pods are
+// selected by the label that holds their backend names, see
+// selectablePods. As the policy isolates the pods for ingress, it
+// also allows all the traffic from the pods of the target namespace,
+// including the VM pods themselves, the health checks from the
+// controller pods, and the traffic to the node ports of the other
+// InnerServices of the cluster which use the same pods and have no
+// NetworkPolicies of their own, see otherInnerServices. It returns
+// nil if no policy is needed for the InnerService.
+func (r *reconciler) makeNetworkPolicy(isvc *v1alpha1.InnerService, pods map[string]*v1.Pod, others []v1alpha1.InnerService) *networkingv1.NetworkPolicy {
+	if !r.needsNetworkPolicy(isvc) {
+		return nil
+	}
+
+	nameLabel := r.backend.NameLabel()
+	var backendNames []string
+	selectedNodes := make(map[string]bool)
+	for _, node := range nodes(isvc) {
+		pod := pods[node.Name]
+		if pod == nil || pod.Labels[nameLabel] == "" {
+			continue
+		}
+		backendNames = append(backendNames, pod.Labels[nameLabel])
+		selectedNodes[node.Name] = true
+	}
+	if len(backendNames) == 0 {
+		return nil
+	}
+
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, cidr := range isvc.Spec.LoadBalancerSourceRanges {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+
+	var ports []networkingv1.NetworkPolicyPort
+	for _, p := range isvc.Spec.Ports {
+		ports = append(ports, policyPort(p.Protocol, p.NodePort))
+	}
+	rules := []networkingv1.NetworkPolicyIngressRule{
+		{
+			Ports: ports,
+			From:  peers,
+		},
+		// the inner cluster needs the VMs to talk to each other,
+		// e.g. for its pod network, apiserver and kubelets
+		{
+			From: []networkingv1.NetworkPolicyPeer{
+				{PodSelector: &metav1.LabelSelector{}},
+			},
+		},
+	}
+
+	var healthCheckPorts, otherPorts []networkingv1.NetworkPolicyPort
+	if isvc.Spec.HealthCheckNodePort != 0 {
+		healthCheckPorts = append(healthCheckPorts, policyPort(v1.ProtocolTCP, isvc.Spec.HealthCheckNodePort))
+	}
+	seen := make(map[string]bool)
+	for n := range others {
+		other := &others[n]
+		if !usesNodes(other, selectedNodes) {
+			continue
+		}
+		if other.Spec.HealthCheckNodePort != 0 {
+			healthCheckPorts = append(healthCheckPorts, policyPort(v1.ProtocolTCP, other.Spec.HealthCheckNodePort))
+		}
+		for _, p := range other.Spec.Ports {
+			key := fmt.Sprintf("%d/%s", p.NodePort, p.Protocol)
+			if p.NodePort == 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			otherPorts = append(otherPorts, policyPort(p.Protocol, p.NodePort))
+		}
+	}
+
+	if len(healthCheckPorts) > 0 {
+		rule := networkingv1.NetworkPolicyIngressRule{Ports: healthCheckPorts}
+		// without the controller pod labels, the health check
+		// ports are open to everyone. The controller pods may run
+		// in any namespace.
+		if len(r.controllerLabels) > 0 {
+			rule.From = []networkingv1.NetworkPolicyPeer{
+				{
+					PodSelector:       &metav1.LabelSelector{MatchLabels: r.controllerLabels},
+					NamespaceSelector: &metav1.LabelSelector{},
+				},
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if len(otherPorts) > 0 {
+		rules = append(rules, networkingv1.NetworkPolicyIngressRule{Ports: otherPorts})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.targetNamespace,
+			Name:      isvc.Name,
+			Labels:    clusterLabels(isvc),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{
+						Key:      nameLabel,
+						Operator: metav1.LabelSelectorOpIn,
+						Values:   backendNames,
+					},
+				},
+			},
+			Ingress:     rules,
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}
+}
+
+// selectablePods returns the VM pods that can be selected by the
+// NetworkPolicy of the InnerService along with the names of the
+// ones that can't. The latter must not receive the traffic, as the
+// source ranges wouldn't be enforced for them.
+func (r *reconciler) selectablePods(isvc *v1alpha1.InnerService, pods map[string]*v1.Pod) (map[string]*v1.Pod, []string) {
+	if !r.needsNetworkPolicy(isvc) {
+		return pods, nil
+	}
+	nameLabel := r.backend.NameLabel()
+	selectable := make(map[string]*v1.Pod)
+	var unselectable []string
+	for _, node := range nodes(isvc) {
+		pod := pods[node.Name]
+		if pod == nil {
+			continue
+		}
+		if pod.Labels[nameLabel] == "" {
+			klog.Warningf("VM pod %s/%s has no %s label, can't select it in the NetworkPolicy", pod.Namespace, pod.Name, nameLabel)
+			unselectable = append(unselectable, pod.Name)
+			continue
+		}
+		selectable[node.Name] = pod
+	}
+	return selectable, unselectable
+}
+
+func policyPort(protocol v1.Protocol, port int32) networkingv1.NetworkPolicyPort {
+	if protocol == "" {
+		protocol = v1.ProtocolTCP
+	}
+	p := intstr.FromInt(int(port))
+	return networkingv1.NetworkPolicyPort{
+		Protocol: &protocol,
+		Port:     &p,
+	}
+}
+
+// usesNodes returns true if any of the InnerService's nodes is in
+// the specified set
+func usesNodes(isvc *v1alpha1.InnerService, nodeSet map[string]bool) bool {
+	for _, node := range nodes(isvc) {
+		if nodeSet[node.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// otherInnerServices returns the InnerServices of the same cluster
+// as the specified one which have no NetworkPolicies of their own,
+// so their node ports must be opened by the NetworkPolicies of the
+// other InnerServices. If the InnerIngresses are enabled, their
+// node ports are included as InnerServices, too, see
+// backendService.
+func (r *reconciler) otherInnerServices(isvc *v1alpha1.InnerService) ([]v1alpha1.InnerService, error) {
+	var isvcs v1alpha1.InnerServiceList
+	listOpts := client.InNamespace(isvc.Namespace).MatchingLabels(map[string]string{
+		v1alpha1.ClusterLabel: isvc.Spec.ClusterID,
+	})
+	if err := r.client.List(context.TODO(), listOpts, &isvcs); err != nil {
+		return nil, fmt.Errorf("error listing InnerServices: %v", err)
+	}
+	var others []v1alpha1.InnerService
+	for _, other := range isvcs.Items {
+		if other.Name != isvc.Name && other.DeletionTimestamp == nil && !r.needsNetworkPolicy(&other) {
+			others = append(others, other)
+		}
+	}
+	if !r.ingresses {
+		return others, nil
+	}
+
+	var iings v1alpha1.InnerIngressList
+	if err := r.client.List(context.TODO(), listOpts, &iings); err != nil {
+		return nil, fmt.Errorf("error listing InnerIngresses: %v", err)
+	}
+	for n := range iings.Items {
+		if iings.Items[n].DeletionTimestamp == nil {
+			others = append(others, *backendService(&iings.Items[n]))
+		}
+	}
+	return others, nil
+}
+
+// specChanged returns true if the spec of the InnerService or the
+// InnerIngress has changed
+func specChanged(oldObj, newObj interface{}) bool {
+	switch o := oldObj.(type) {
+	case *v1alpha1.InnerService:
+		n, ok := newObj.(*v1alpha1.InnerService)
+		return !ok || !reflect.DeepEqual(o.Spec, n.Spec)
+	case *v1alpha1.InnerIngress:
+		n, ok := newObj.(*v1alpha1.InnerIngress)
+		return !ok || !reflect.DeepEqual(o.Spec, n.Spec)
+	default:
+		return true
+	}
+}
+
+// networkPolicyServicesFor returns reconcile requests for the other
+// InnerServices of the cluster of the InnerService or the
+// InnerIngress that have NetworkPolicies, as these policies open the
+// node ports of the object
+func (r *reconciler) networkPolicyServicesFor(obj interface{}) []reconcile.Request {
+	var namespace, name, clusterID string
+	switch o := obj.(type) {
+	case *v1alpha1.InnerService:
+		namespace, name, clusterID = o.Namespace, o.Name, o.Spec.ClusterID
+	case *v1alpha1.InnerIngress:
+		namespace, name, clusterID = o.Namespace, o.Name, o.Spec.ClusterID
+	default:
+		return nil
+	}
+	var isvcs v1alpha1.InnerServiceList
+	listOpts := client.InNamespace(namespace).MatchingLabels(map[string]string{
+		v1alpha1.ClusterLabel: clusterID,
+	})
+	if err := r.client.List(context.TODO(), listOpts, &isvcs); err != nil {
+		klog.Warningf("error listing InnerServices: %v", err)
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, other := range isvcs.Items {
+		if other.Name != name && r.needsNetworkPolicy(&other) {
+			reqs = append(reqs, reconcile.Request{
+				Context: r.clusterName,
+				NamespacedName: types.NamespacedName{
+					Namespace: other.Namespace,
+					Name:      other.Name,
+				},
+			})
+		}
+	}
+	return reqs
+}
+
+// syncNetworkPolicy creates or updates the NetworkPolicy with the
+// specified name. If np is nil, the NetworkPolicy is deleted.
+func (r *reconciler) syncNetworkPolicy(nsn types.NamespacedName, np *networkingv1.NetworkPolicy) error {
+	curNp := &networkingv1.NetworkPolicy{}
+	if err := r.client.Get(context.TODO(), nsn, curNp); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		curNp = nil
+	}
+
+	switch {
+	case curNp != nil && !managed(curNp):
+		klog.Warningf("NetworkPolicy %s is not managed by virtletlb, not touching it", nsn)
+		return nil
+	case np == nil && curNp == nil:
+		return nil
+	case np == nil:
+		klog.V(1).Infof("deleting NetworkPolicy %s", nsn)
+		if err := r.client.Delete(context.TODO(), curNp); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	case curNp == nil:
+		klog.V(1).Infof("creating NetworkPolicy %s", nsn)
+		return r.client.Create(context.TODO(), np)
+	case reflect.DeepEqual(curNp.Spec, np.Spec) && reflect.DeepEqual(curNp.Labels, np.Labels):
+		return nil
+	default:
+		klog.V(1).Infof("NetworkPolicy mismatch! WAS:\n%s\n\nNOW:\n%s\n", ToJSON(curNp.Spec), ToJSON(np.Spec))
+		curNp.Labels = np.Labels
+		curNp.Spec = np.Spec
+		return r.client.Update(context.TODO(), curNp)
+	}
+}
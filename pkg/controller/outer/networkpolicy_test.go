@@ -0,0 +1,317 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/ivan4th/virtletlb/pkg/apis"
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/locator"
+)
+
+func innerService(clusterID, name string, nodeNames []string, ports ...int32) *v1alpha1.InnerService {
+	isvc := &v1alpha1.InnerService{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      clusterID + "-default-" + name,
+			Labels: map[string]string{
+				v1alpha1.ClusterLabel: clusterID,
+			},
+		},
+		Spec: v1alpha1.InnerServiceSpec{
+			ClusterID: clusterID,
+			NodeNames: nodeNames,
+		},
+	}
+	for n, port := range ports {
+		isvc.Spec.Ports = append(isvc.Spec.Ports, v1alpha1.InnerServicePort{
+			Protocol: v1.ProtocolTCP,
+			Port:     int32(80 + n),
+			NodePort: port,
+		})
+	}
+	return isvc
+}
+
+func vmPod(name string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels: map[string]string{
+				"statefulset.kubernetes.io/pod-name": name,
+			},
+		},
+	}
+}
+
+func newBackend(t *testing.T, kind string) locator.Backend {
+	backend, err := locator.NewBackend(kind, fake.NewFakeClient(), "default", "")
+	if err != nil {
+		t.Fatalf("error making the backend: %v", err)
+	}
+	return backend
+}
+
+func ruleFor(np *networkingv1.NetworkPolicy, port int32) *networkingv1.NetworkPolicyIngressRule {
+	for n, rule := range np.Spec.Ingress {
+		for _, p := range rule.Ports {
+			if *p.Port == intstr.FromInt(int(port)) {
+				return &np.Spec.Ingress[n]
+			}
+		}
+	}
+	return nil
+}
+
+func TestNetworkPolicyForSharedVMs(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	if err := apis.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("error adding APIs to the scheme: %v", err)
+	}
+
+	// restricted has the source ranges and the health check,
+	// open shares the VMs with it, elsewhere uses another VM,
+	// and foreign belongs to another cluster
+	restricted := innerService("k8s", "restricted", []string{"k8s-0", "k8s-1"}, 30080)
+	restricted.Spec.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+	restricted.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	restricted.Spec.HealthCheckNodePort = 32000
+	open := innerService("k8s", "open", []string{"k8s-1", "k8s-2"}, 30081, 30082)
+	open.Spec.HealthCheckNodePort = 32001
+	elsewhere := innerService("k8s", "elsewhere", []string{"k8s-2"}, 30083)
+	foreign := innerService("other", "foreign", []string{"k8s-0"}, 30084)
+
+	var objs []runtime.Object
+	for _, isvc := range []*v1alpha1.InnerService{restricted, open, elsewhere, foreign} {
+		objs = append(objs, isvc)
+	}
+	r := &reconciler{
+		client:           fake.NewFakeClient(objs...),
+		backend:          newBackend(t, locator.StatefulSetBackend),
+		clusterName:      "outer",
+		targetNamespace:  "default",
+		networkPolicies:  true,
+		controllerLabels: map[string]string{"control-plane": "virtletlb-outer"},
+	}
+	pods := map[string]*v1.Pod{
+		"k8s-0": vmPod("k8s-0"),
+		"k8s-1": vmPod("k8s-1"),
+		"k8s-2": vmPod("k8s-2"),
+	}
+
+	others, err := r.otherInnerServices(restricted)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	var otherNames []string
+	for _, other := range others {
+		otherNames = append(otherNames, other.Name)
+	}
+	g.Expect(otherNames).To(gomega.ConsistOf("k8s-default-open", "k8s-default-elsewhere"))
+
+	np := r.makeNetworkPolicy(restricted, pods, others)
+	g.Expect(np).NotTo(gomega.BeNil())
+	g.Expect(np.Spec.PodSelector.MatchExpressions[0].Values).To(gomega.Equal([]string{"k8s-0", "k8s-1"}))
+
+	// the service's own node port is only open to the source ranges
+	rule := ruleFor(np, 30080)
+	g.Expect(rule).NotTo(gomega.BeNil())
+	g.Expect(rule.From).To(gomega.Equal([]networkingv1.NetworkPolicyPeer{
+		{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}},
+	}))
+
+	// the pods of the namespace, including the VM pods, can
+	// reach any port
+	g.Expect(np.Spec.Ingress).To(gomega.ContainElement(networkingv1.NetworkPolicyIngressRule{
+		From: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+	}))
+
+	// the health check ports are open to the controller pods
+	for _, port := range []int32{32000, 32001} {
+		rule = ruleFor(np, port)
+		g.Expect(rule).NotTo(gomega.BeNil(), "port %d", port)
+		g.Expect(rule.From).To(gomega.Equal([]networkingv1.NetworkPolicyPeer{
+			{
+				PodSelector:       &metav1.LabelSelector{MatchLabels: r.controllerLabels},
+				NamespaceSelector: &metav1.LabelSelector{},
+			},
+		}))
+	}
+
+	// the node ports of the other service on the same VMs are
+	// open to everyone
+	for _, port := range []int32{30081, 30082} {
+		rule = ruleFor(np, port)
+		g.Expect(rule).NotTo(gomega.BeNil(), "port %d", port)
+		g.Expect(rule.From).To(gomega.BeEmpty())
+	}
+
+	// the services that don't use the same VMs and the services
+	// of the other clusters are not affected
+	g.Expect(ruleFor(np, 30083)).To(gomega.BeNil())
+	g.Expect(ruleFor(np, 30084)).To(gomega.BeNil())
+
+	// the changes in the open service trigger the update of the
+	// restricted service's policy
+	reqs := r.networkPolicyServicesFor(open)
+	g.Expect(reqs).To(gomega.HaveLen(1))
+	g.Expect(reqs[0].Name).To(gomega.Equal(restricted.Name))
+
+	// no policy is needed for the open service
+	g.Expect(r.makeNetworkPolicy(open, pods, nil)).To(gomega.BeNil())
+}
+
+func TestUnselectablePodsGetNoTraffic(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := &reconciler{
+		backend:         newBackend(t, locator.StatefulSetBackend),
+		targetNamespace: "default",
+		networkPolicies: true,
+	}
+	isvc := innerService("k8s", "restricted", []string{"k8s-0", "k8s-1", "k8s-2"}, 30080)
+	isvc.Spec.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+	unlabeled := vmPod("vm-1")
+	unlabeled.Labels = nil
+	pods := map[string]*v1.Pod{
+		"k8s-0": vmPod("k8s-0"),
+		"k8s-1": unlabeled,
+	}
+
+	selectable, unselectable := r.selectablePods(isvc, pods)
+	g.Expect(unselectable).To(gomega.Equal([]string{"vm-1"}))
+	g.Expect(selectable).To(gomega.Equal(map[string]*v1.Pod{"k8s-0": pods["k8s-0"]}))
+
+	np := r.makeNetworkPolicy(isvc, selectable, nil)
+	g.Expect(np).NotTo(gomega.BeNil())
+	g.Expect(np.Spec.PodSelector.MatchExpressions[0].Values).To(gomega.Equal([]string{"k8s-0"}))
+
+	// without the source ranges, all of the pods are used
+	isvc.Spec.LoadBalancerSourceRanges = nil
+	selectable, unselectable = r.selectablePods(isvc, pods)
+	g.Expect(unselectable).To(gomega.BeEmpty())
+	g.Expect(selectable).To(gomega.Equal(pods))
+}
+
+func TestNetworkPolicyForKubeVirt(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	r := &reconciler{
+		backend:         newBackend(t, locator.KubeVirtBackend),
+		targetNamespace: "default",
+		networkPolicies: true,
+	}
+	isvc := innerService("k8s", "restricted", []string{"vm-0"}, 30080)
+	isvc.Spec.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+	pods := map[string]*v1.Pod{
+		"vm-0": {
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "virt-launcher-vm-0-x7k2p",
+				Labels: map[string]string{
+					"kubevirt.io":        "virt-launcher",
+					"kubevirt.io/domain": "vm-0",
+				},
+			},
+		},
+	}
+
+	// virt-launcher pods have no StatefulSet labels, so they're
+	// selected by their domain labels
+	selectable, unselectable := r.selectablePods(isvc, pods)
+	g.Expect(unselectable).To(gomega.BeEmpty())
+	np := r.makeNetworkPolicy(isvc, selectable, nil)
+	g.Expect(np).NotTo(gomega.BeNil())
+	g.Expect(np.Spec.PodSelector.MatchExpressions).To(gomega.Equal([]metav1.LabelSelectorRequirement{
+		{
+			Key:      "kubevirt.io/domain",
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   []string{"vm-0"},
+		},
+	}))
+}
+
+func innerIngress(clusterID, name string, nodePort int32, nodeNames ...string) *v1alpha1.InnerIngress {
+	return &v1alpha1.InnerIngress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      clusterID + "-default-" + name,
+			Labels: map[string]string{
+				v1alpha1.ClusterLabel: clusterID,
+			},
+		},
+		Spec: v1alpha1.InnerIngressSpec{
+			ClusterID: clusterID,
+			NodePort:  nodePort,
+			NodeNames: nodeNames,
+		},
+	}
+}
+
+func TestNetworkPolicyForInnerIngresses(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	if err := apis.AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("error adding APIs to the scheme: %v", err)
+	}
+
+	restricted := innerService("k8s", "restricted", []string{"k8s-0", "k8s-1"}, 30080)
+	restricted.Spec.LoadBalancerSourceRanges = []string{"10.0.0.0/8"}
+	web := innerIngress("k8s", "web", 31080, "k8s-1")
+	elsewhere := innerIngress("k8s", "elsewhere", 31081, "k8s-2")
+	r := &reconciler{
+		client:          fake.NewFakeClient(restricted, web, elsewhere),
+		backend:         newBackend(t, locator.StatefulSetBackend),
+		clusterName:     "outer",
+		targetNamespace: "default",
+		networkPolicies: true,
+	}
+	pods := map[string]*v1.Pod{
+		"k8s-0": vmPod("k8s-0"),
+		"k8s-1": vmPod("k8s-1"),
+	}
+
+	// without the ingresses, the InnerIngresses are ignored
+	others, err := r.otherInnerServices(restricted)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(others).To(gomega.BeEmpty())
+
+	r.ingresses = true
+	others, err = r.otherInnerServices(restricted)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	np := r.makeNetworkPolicy(restricted, pods, others)
+	g.Expect(np).NotTo(gomega.BeNil())
+
+	// the outer ingress controller can reach the node port of
+	// the InnerIngress on the same VMs
+	rule := ruleFor(np, 31080)
+	g.Expect(rule).NotTo(gomega.BeNil())
+	g.Expect(rule.From).To(gomega.BeEmpty())
+	g.Expect(ruleFor(np, 31081)).To(gomega.BeNil())
+
+	// the changes in the InnerIngress trigger the update of the
+	// restricted service's policy
+	reqs := r.networkPolicyServicesFor(web)
+	g.Expect(reqs).To(gomega.HaveLen(1))
+	g.Expect(reqs[0].Name).To(gomega.Equal(restricted.Name))
+}
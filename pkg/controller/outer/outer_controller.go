@@ -39,14 +39,18 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
+	"time"
 
 	"admiralty.io/multicluster-controller/pkg/cluster"
 	"admiralty.io/multicluster-controller/pkg/controller"
 	"admiralty.io/multicluster-controller/pkg/reconcile"
 	"admiralty.io/multicluster-controller/pkg/reference"
 	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/klog"
@@ -54,6 +58,10 @@ import (
 
 	"github.com/ivan4th/virtletlb/pkg/apis"
 	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/finalizer"
+	"github.com/ivan4th/virtletlb/pkg/handler"
+	"github.com/ivan4th/virtletlb/pkg/keyfilter"
+	"github.com/ivan4th/virtletlb/pkg/locator"
 )
 
 func ToJSON(o interface{}) string {
@@ -66,14 +74,81 @@ func ToJSON(o interface{}) string {
 
 var skipRx *regexp.Regexp = regexp.MustCompile("^kube-system/(kube-scheduler|kube-controller-manager)$")
 
-func NewController(cluster *cluster.Cluster, targetNamespace string) (*controller.Controller, error) {
+const (
+	// outerFinalizer is set on the InnerServices so that their
+	// outer services are guaranteed to be deleted with them
+	outerFinalizer = "virtletlb.virtlet.cloud/outer-controller"
+	// finalizerRequeueInterval specifies how often the deletion of
+	// the outer service is checked during the finalization
+	finalizerRequeueInterval = 2 * time.Second
+)
+
+// Options specifies the options of the outer controller
+type Options struct {
+	// NetworkPolicies enables generation of NetworkPolicies that
+	// enforce loadBalancerSourceRanges for the VM pods in case if
+	// the load balancer implementation ignores them. The outer
+	// services with source ranges use "Local" externalTrafficPolicy
+	// then so as to preserve client IPs. Note that the VM pods
+	// selected by such policies become isolated for ingress, so
+	// the rest of their traffic must be allowed by other policies.
+	NetworkPolicies bool
+	// ControllerLabels specifies the labels of the outer controller
+	// pods. The NetworkPolicies allow the health checks of the VM
+	// pods from these pods only. If it's empty, the health check
+	// node ports are open to everyone.
+	ControllerLabels map[string]string
+	// AnnotationFilter and LabelFilter specify the allow-lists for
+	// the annotations and labels of the inner services that are
+	// copied to the outer services
+	AnnotationFilter *keyfilter.Filter
+	LabelFilter      *keyfilter.Filter
+	// NodeLocator specifies the kind of the locator that finds the
+	// VM pods for the inner nodes, see the locator package. The
+	// default is locator.NodeName.
+	NodeLocator string
+	// Backend specifies the kind of the VMs or nested cluster nodes
+	// in the outer cluster, see locator.Backend. The default is
+	// locator.StatefulSetBackend.
+	Backend string
+	// BackendLabel specifies the label that holds the backend name
+	// for locator.PodBackend
+	BackendLabel string
+	// Ingresses enables the controller that makes the outer
+	// Ingresses for the InnerIngresses, see NewIngressController
+	Ingresses bool
+	// IngressClass specifies the kubernetes.io/ingress.class
+	// annotation of the outer Ingresses made for the
+	// InnerIngresses. Empty value means no annotation.
+	IngressClass string
+}
+
+func NewController(cluster *cluster.Cluster, targetNamespace string, opts Options) (*controller.Controller, error) {
 	klog.V(1).Infof("*** starting watch ***")
 	client, err := cluster.GetDelegatingClient()
 	if err != nil {
 		return nil, fmt.Errorf("getting delegating client for source cluster: %v", err)
 	}
 
-	co := controller.New(&reconciler{client: client, targetNamespace: targetNamespace}, controller.Options{})
+	backend, nodeLocator, err := newLocator(client, targetNamespace, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reconciler{
+		client:           client,
+		backend:          backend,
+		locator:          nodeLocator,
+		clusterName:      cluster.GetClusterName(),
+		targetNamespace:  targetNamespace,
+		healthChecker:    newHealthChecker(healthCheckTimeout),
+		networkPolicies:  opts.NetworkPolicies,
+		controllerLabels: opts.ControllerLabels,
+		annotationFilter: opts.AnnotationFilter,
+		labelFilter:      opts.LabelFilter,
+		ingresses:        opts.Ingresses,
+	}
+	co := controller.New(r, controller.Options{})
 
 	if err := co.WatchResourceReconcileObject(cluster, &v1.Endpoints{}, controller.WatchOptions{}); err != nil {
 		return nil, fmt.Errorf("setting up Endpoints watch in the cluster: %v", err)
@@ -81,6 +156,38 @@ func NewController(cluster *cluster.Cluster, targetNamespace string) (*controlle
 	if err := co.WatchResourceReconcileObject(cluster, &v1alpha1.InnerService{}, controller.WatchOptions{}); err != nil {
 		return nil, fmt.Errorf("setting up InnerService watch in the cluster: %v", err)
 	}
+	// the outer services are mapped back to their InnerServices
+	// via the controller references, so that the load balancer
+	// status is propagated as soon as the IPs are assigned
+	if err := co.WatchResourceReconcileController(cluster, &v1.Service{}, controller.WatchOptions{}); err != nil {
+		return nil, fmt.Errorf("setting up Service watch in the cluster: %v", err)
+	}
+	// VM pods may come, go or change their IPs, so the Endpoints
+	// of the InnerServices that use them must be updated
+	if err := cluster.AddEventHandler(&v1.Pod{}, &handler.EnqueueRequestsFromMapFunc{
+		Queue:      co.Queue,
+		ToRequests: r.innerServicesForPod,
+	}); err != nil {
+		return nil, fmt.Errorf("setting up Pod watch in the cluster: %v", err)
+	}
+	// the NetworkPolicies open the node ports of the other
+	// InnerServices and the InnerIngresses that use the same VM
+	// pods
+	if opts.NetworkPolicies {
+		objs := []runtime.Object{&v1alpha1.InnerService{}}
+		if opts.Ingresses {
+			objs = append(objs, &v1alpha1.InnerIngress{})
+		}
+		for _, obj := range objs {
+			if err := cluster.AddEventHandler(obj, &handler.EnqueueRequestsFromMapFunc{
+				Queue:        co.Queue,
+				ToRequests:   r.networkPolicyServicesFor,
+				UpdateFilter: specChanged,
+			}); err != nil {
+				return nil, fmt.Errorf("setting up %T watch for NetworkPolicies in the cluster: %v", obj, err)
+			}
+		}
+	}
 
 	if err := apis.AddToScheme(cluster.GetScheme()); err != nil {
 		return nil, fmt.Errorf("adding APIs to dest cluster's scheme: %v", err)
@@ -91,9 +198,41 @@ func NewController(cluster *cluster.Cluster, targetNamespace string) (*controlle
 	return co, nil
 }
 
+// newLocator makes the backend and the node locator specified by
+// the options
+func newLocator(c client.Client, targetNamespace string, opts Options) (locator.Backend, locator.NodeLocator, error) {
+	backendKind := opts.Backend
+	if backendKind == "" {
+		backendKind = locator.StatefulSetBackend
+	}
+	backend, err := locator.NewBackend(backendKind, c, targetNamespace, opts.BackendLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locatorKind := opts.NodeLocator
+	if locatorKind == "" {
+		locatorKind = locator.NodeName
+	}
+	nodeLocator, err := locator.New(locatorKind, backend, c, targetNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	return backend, nodeLocator, nil
+}
+
 type reconciler struct {
-	client          client.Client
-	targetNamespace string
+	client           client.Client
+	backend          locator.Backend
+	locator          locator.NodeLocator
+	clusterName      string
+	targetNamespace  string
+	healthChecker    *healthChecker
+	networkPolicies  bool
+	controllerLabels map[string]string
+	annotationFilter *keyfilter.Filter
+	labelFilter      *keyfilter.Filter
+	ingresses        bool
 }
 
 func (r *reconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
@@ -112,39 +251,112 @@ func (r *reconciler) Reconcile(req reconcile.Request) (reconcile.Result, error)
 		}
 	}
 
-	if curSvc != nil && curSvc.Spec.Type != "LoadBalancer" {
-		klog.V(1).Infof("ignoring service %s of type %s", reqName, curSvc.Spec.Type)
-		return reconcile.Result{}, nil
-	}
-
 	innerSvc := &v1alpha1.InnerService{}
 	if err := r.client.Get(context.TODO(), req.NamespacedName, innerSvc); err != nil {
 		if errors.IsNotFound(err) {
+			// this may only happen to the InnerServices which
+			// don't have the finalizer, e.g. the ones that were
+			// deleted before they were seen by the controller
 			klog.V(1).Infof("no inner svc for %v; deleting service, if it exists", reqName)
-			// ...TODO: multicluster garbage collector
-			// Until then...
-			err := r.deleteService(r.targetNamespacedName(req.NamespacedName))
+			_, err := r.deleteService(r.targetNamespacedName(req.NamespacedName))
 			return reconcile.Result{}, err
 		}
 		return reconcile.Result{}, err
 	}
 
+	if innerSvc.DeletionTimestamp != nil {
+		klog.V(1).Infof("inner svc %v is being deleted", reqName)
+		return r.finalizeInnerService(innerSvc)
+	}
+
+	if finalizer.Add(innerSvc, outerFinalizer) {
+		klog.V(1).Infof("adding finalizer to inner svc %v", reqName)
+		if err := r.client.Update(context.TODO(), innerSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	ownerRef := reference.NewMulticlusterOwnerReference(innerSvc, innerSvc.GroupVersionKind(), req.Context)
 	svc := r.makeService(innerSvc)
-	reference.SetMulticlusterControllerReference(svc, reference.NewMulticlusterOwnerReference(innerSvc, innerSvc.GroupVersionKind(), req.Context))
+	reference.SetMulticlusterControllerReference(svc, ownerRef)
+	pods, err := r.locatePods(innerSvc)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	pods, unselectable := r.selectablePods(innerSvc, pods)
+	ep := r.makeEndpoints(innerSvc, pods)
+	reference.SetMulticlusterControllerReference(ep, ownerRef)
+	var others []v1alpha1.InnerService
+	if r.needsNetworkPolicy(innerSvc) {
+		if others, err = r.otherInnerServices(innerSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	np := r.makeNetworkPolicy(innerSvc, pods, others)
+	if np != nil {
+		reference.SetMulticlusterControllerReference(np, ownerRef)
+	}
 
-	if curSvc == nil {
+	status := innerSvc.Status.DeepCopy()
+	conflictErr := checkPorts(innerSvc)
+	if conflictErr != nil {
+		// retrying won't help with conflicts until the spec changes
+		klog.Warningf("bad ports for %v: %v", reqName, conflictErr)
+		status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionFalse, "PortConflict", conflictErr.Error())
+	} else if curSvc != nil && (!belongsToCluster(curSvc, innerSvc.Spec.ClusterID) || ingressObject(curSvc)) {
+		// the outer service is either not managed by us, belongs
+		// to another inner cluster or serves an InnerIngress, so
+		// it must not be touched
+		conflictErr = fmt.Errorf("service %s/%s already exists and doesn't belong to cluster %q", curSvc.Namespace, curSvc.Name, innerSvc.Spec.ClusterID)
+		klog.Warningf("%v", conflictErr)
+		status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionFalse, "NameConflict", conflictErr.Error())
+	} else if curSvc == nil {
 		klog.V(1).Infof("not found: %v, creating new service for %v", r.targetNamespacedName(req.NamespacedName), reqName)
 		klog.V(1).Infof("content:\n%s\n", ToJSON(svc))
-		err := r.client.Create(context.TODO(), svc)
-		return reconcile.Result{}, err
+		if err = r.client.Create(context.TODO(), svc); err != nil {
+			status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionFalse, "ServiceCreateFailed", err.Error())
+		} else {
+			status.NodePorts = nodePorts(svc)
+		}
+	} else {
+		if err = r.updateService(curSvc, svc, innerSvc); err != nil {
+			status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionFalse, "ServiceUpdateFailed", err.Error())
+		}
+		status.LoadBalancer = *curSvc.Status.LoadBalancer.DeepCopy()
+		status.NodePorts = nodePorts(curSvc)
+	}
+
+	if conflictErr == nil && err == nil {
+		if err = r.syncBackends(ep, np); err != nil {
+			status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionFalse, "BackendsSyncFailed", err.Error())
+		} else if len(unselectable) > 0 {
+			// such pods are left out of the Endpoints
+			status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionFalse, "PodsNotSelectable",
+				fmt.Sprintf("The NetworkPolicy can't select VM pod(s) %s, so they receive no traffic", strings.Join(unselectable, ", ")))
+			status.ObservedGeneration = innerSvc.Generation
+		} else {
+			status.SetCondition(v1alpha1.InnerServiceSynced, v1.ConditionTrue, "Synced", "")
+			status.ObservedGeneration = innerSvc.Generation
+		}
 	}
+	setBackendsReadyCondition(status, innerSvc, ep)
+	setAddressAssignedCondition(status, innerSvc)
 
+	if statusErr := r.updateStatus(innerSvc, status); err == nil {
+		err = statusErr
+	}
+
+	return r.result(innerSvc), err
+}
+
+// updateService updates the outer service if it doesn't match the
+// one made for the InnerService
+func (r *reconciler) updateService(curSvc, svc *v1.Service, innerSvc *v1alpha1.InnerService) error {
 	// Some parts of the spec are updated by kube-controller-manager,
 	// let's skip updating the service if other parts didn't change
 	// FIXME: do it in a more sane and futureproof way
 	svc.Spec.ClusterIP = curSvc.Spec.ClusterIP
-	svc.Spec.SessionAffinity = curSvc.Spec.SessionAffinity
-	svc.Spec.ExternalTrafficPolicy = curSvc.Spec.ExternalTrafficPolicy
+	svc.Spec.HealthCheckNodePort = curSvc.Spec.HealthCheckNodePort
 	if len(svc.Spec.Ports) == len(curSvc.Spec.Ports) {
 		for n, p := range curSvc.Spec.Ports {
 			svc.Spec.Ports[n].NodePort = p.NodePort
@@ -156,33 +368,134 @@ func (r *reconciler) Reconcile(req reconcile.Request) (reconcile.Result, error)
 	if shouldUpdate {
 		klog.V(1).Infof("spec mismatch! WAS:\n%s\n\nNOW:\n%s\n", ToJSON(curSvc.Spec), ToJSON(svc.Spec))
 	}
+	if r.applyPassthroughMetadata(curSvc, innerSvc) {
+		klog.V(1).Infof("labels/annotations changed")
+		shouldUpdate = true
+	}
+	if applyOriginAnnotations(curSvc, innerSvc) {
+		klog.V(1).Infof("origin annotations changed")
+		shouldUpdate = true
+	}
+	if !shouldUpdate {
+		return nil
+	}
+
+	klog.V(1).Infof("updating the outer service")
+	curSvc.Spec = svc.Spec
+	return r.client.Update(context.TODO(), curSvc)
+}
 
-	lbIP := ""
-	if len(curSvc.Status.LoadBalancer.Ingress) > 0 {
-		lbIP = curSvc.Status.LoadBalancer.Ingress[0].IP
+// updateStatus updates the status of the InnerService if it differs
+// from the specified one
+func (r *reconciler) updateStatus(innerSvc *v1alpha1.InnerService, status *v1alpha1.InnerServiceStatus) error {
+	if reflect.DeepEqual(&innerSvc.Status, status) {
+		return nil
 	}
-	klog.V(1).Infof("current service lbIP: %q", lbIP)
+	klog.V(1).Infof("outer: updating inner service's status:\n%s", ToJSON(status))
+	innerSvc.Status = *status
+	return r.client.Status().Update(context.TODO(), innerSvc)
+}
 
-	var err error
-	if innerSvc.Status.LoadBalancerIP != lbIP {
-		if !reflect.DeepEqual(curSvc.Status, svc.Status) {
-			klog.V(1).Infof("outer: setting inner service's LbIP to %s", lbIP)
-			innerSvc.Status = v1alpha1.InnerServiceStatus{
-				LoadBalancerIP: lbIP,
+// checkPorts verifies that the ports of the InnerService don't
+// conflict with each other
+func checkPorts(isvc *v1alpha1.InnerService) error {
+	names := make(map[string]bool)
+	ports := make(map[string]bool)
+	for _, p := range isvc.Spec.Ports {
+		if p.Name != "" {
+			if names[p.Name] {
+				return fmt.Errorf("duplicate port name %q", p.Name)
 			}
-			// FIXME: perhaps should be doable via r.client.Status().Update(...)
-			// but it isn't, need to check
-			err = r.client.Update(context.TODO(), innerSvc)
+			names[p.Name] = true
+		}
+		key := fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+		if ports[key] {
+			return fmt.Errorf("duplicate port %s", key)
 		}
+		ports[key] = true
+	}
+	return nil
+}
+
+func setBackendsReadyCondition(status *v1alpha1.InnerServiceStatus, isvc *v1alpha1.InnerService, ep *v1.Endpoints) {
+	ready, notReady := 0, 0
+	for _, subset := range ep.Subsets {
+		ready += len(subset.Addresses)
+		notReady += len(subset.NotReadyAddresses)
+	}
+	switch {
+	case len(isvc.Spec.NodeNames) == 0:
+		status.SetCondition(v1alpha1.InnerServiceBackendsReady, v1.ConditionFalse, "NoBackendNodes", "The InnerService has no nodes")
+	case ready == 0:
+		status.SetCondition(v1alpha1.InnerServiceBackendsReady, v1.ConditionFalse, "NoReadyBackends",
+			fmt.Sprintf("None of %d node(s) has a ready VM pod (%d not ready)", len(isvc.Spec.NodeNames), notReady))
+	default:
+		status.SetCondition(v1alpha1.InnerServiceBackendsReady, v1.ConditionTrue, "BackendsReady",
+			fmt.Sprintf("%d of %d node(s) ready", ready, len(isvc.Spec.NodeNames)))
 	}
+}
 
-	if err == nil && shouldUpdate {
-		klog.V(1).Infof("updating the outer service")
-		curSvc.Spec = svc.Spec
-		err = r.client.Update(context.TODO(), curSvc)
+// nodePorts returns the ports of the outer service along with the
+// allocated node ports
+func nodePorts(svc *v1.Service) []v1alpha1.InnerServicePort {
+	var ports []v1alpha1.InnerServicePort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1alpha1.InnerServicePort{
+			Name:     p.Name,
+			Protocol: p.Protocol,
+			Port:     p.Port,
+			NodePort: p.NodePort,
+		})
 	}
+	return ports
+}
 
-	return reconcile.Result{}, err
+func setAddressAssignedCondition(status *v1alpha1.InnerServiceStatus, isvc *v1alpha1.InnerService) {
+	if isvc.Spec.Type == v1.ServiceTypeNodePort {
+		status.SetCondition(v1alpha1.InnerServiceAddressAssigned, v1.ConditionTrue, "NodePort", "The service is exposed on the outer node ports")
+		return
+	}
+	ingress := status.LoadBalancer.Ingress
+	requestedIP := isvc.Spec.LoadBalancerIP
+	if len(ingress) == 0 {
+		status.SetCondition(v1alpha1.InnerServiceAddressAssigned, v1.ConditionFalse, "Pending", "The outer load balancer has not assigned an address yet")
+		return
+	}
+	if requestedIP != "" {
+		for _, i := range ingress {
+			if i.IP == requestedIP {
+				status.SetCondition(v1alpha1.InnerServiceAddressAssigned, v1.ConditionTrue, "Assigned", "")
+				return
+			}
+		}
+		status.SetCondition(v1alpha1.InnerServiceAddressAssigned, v1.ConditionFalse, "RequestedIPUnavailable",
+			fmt.Sprintf("The outer load balancer could not assign the requested IP %s", requestedIP))
+		return
+	}
+	status.SetCondition(v1alpha1.InnerServiceAddressAssigned, v1.ConditionTrue, "Assigned", "")
+}
+
+// syncBackends syncs the Endpoints of the outer service and, if
+// enabled, its NetworkPolicy. np may be nil, meaning that the
+// service doesn't need a NetworkPolicy.
+func (r *reconciler) syncBackends(ep *v1.Endpoints, np *networkingv1.NetworkPolicy) error {
+	if err := r.syncEndpoints(ep); err != nil {
+		return err
+	}
+	if !r.networkPolicies {
+		return nil
+	}
+	return r.syncNetworkPolicy(types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}, np)
+}
+
+// result returns the reconcile result for the InnerService. The
+// services that have health checks are requeued periodically so
+// that their nodes are probed again.
+func (r *reconciler) result(isvc *v1alpha1.InnerService) reconcile.Result {
+	if isvc.Spec.HealthCheckNodePort != 0 {
+		return reconcile.Result{RequeueAfter: healthCheckInterval}
+	}
+	return reconcile.Result{}
 }
 
 func (r *reconciler) targetNamespacedName(pod types.NamespacedName) types.NamespacedName {
@@ -192,28 +505,114 @@ func (r *reconciler) targetNamespacedName(pod types.NamespacedName) types.Namesp
 	}
 }
 
-func (r *reconciler) deleteService(nsn types.NamespacedName) error {
+// finalizeInnerService deletes the outer service of the InnerService
+// that's being deleted along with its dependents. Once the service is
+// gone, it clears the InnerService's load balancer status and removes
+// the finalizer from it.
+func (r *reconciler) finalizeInnerService(innerSvc *v1alpha1.InnerService) (reconcile.Result, error) {
+	nsn := r.targetNamespacedName(types.NamespacedName{Namespace: innerSvc.Namespace, Name: innerSvc.Name})
+	gone, err := r.deleteService(nsn)
+	switch {
+	case err != nil:
+		return reconcile.Result{}, err
+	case !gone:
+		klog.V(1).Infof("waiting for service %s to be deleted", nsn)
+		return reconcile.Result{RequeueAfter: finalizerRequeueInterval}, nil
+	case !finalizer.Has(innerSvc, outerFinalizer):
+		return reconcile.Result{}, nil
+	}
+
+	if len(innerSvc.Status.LoadBalancer.Ingress) > 0 {
+		klog.V(1).Infof("clearing load balancer status of inner svc %s/%s", innerSvc.Namespace, innerSvc.Name)
+		innerSvc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+		if err := r.client.Status().Update(context.TODO(), innerSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	klog.V(1).Infof("removing finalizer from inner svc %s/%s", innerSvc.Namespace, innerSvc.Name)
+	finalizer.Remove(innerSvc, outerFinalizer)
+	return reconcile.Result{}, r.client.Update(context.TODO(), innerSvc)
+}
+
+// deleteService deletes the outer service and its dependents. It
+// returns true if the service is gone.
+func (r *reconciler) deleteService(nsn types.NamespacedName) (bool, error) {
 	svc := &v1.Service{}
 	if err := r.client.Get(context.TODO(), nsn, svc); err != nil {
 		if errors.IsNotFound(err) {
 			// all good
-			return nil
+			return true, r.deleteDependents(nsn)
+		}
+		return false, err
+	}
+	if !managed(svc) || ingressObject(svc) {
+		klog.V(1).Infof("service %s is not managed by virtletlb or belongs to an InnerIngress, not deleting it", nsn)
+		return true, nil
+	}
+	if svc.DeletionTimestamp == nil {
+		if err := r.client.Delete(context.TODO(), svc); err != nil && !errors.IsNotFound(err) {
+			return false, err
 		}
-		return err
 	}
-	if err := r.client.Delete(context.TODO(), svc); err != nil {
+	// the service may have finalizers of its own, e.g. the ones
+	// set by the load balancer implementation, so it's only
+	// considered gone when it can't be found
+	return false, nil
+}
+
+// deleteDependents deletes the Endpoints and NetworkPolicy of the
+// outer service
+func (r *reconciler) deleteDependents(nsn types.NamespacedName) error {
+	if err := r.deleteEndpoints(nsn); err != nil {
 		return err
 	}
-	return nil
+	if !r.networkPolicies {
+		return nil
+	}
+	return r.syncNetworkPolicy(nsn, nil)
 }
 
+// makeService makes an outer service for the InnerService.  The
+// service has no selector, its Endpoints are managed by the
+// controller and point to the VM pods that correspond to the
+// InnerService's nodes.
 func (r *reconciler) makeService(isvc *v1alpha1.InnerService) *v1.Service {
-	var selector map[string]string
-	if len(isvc.Spec.NodeNames) > 0 {
-		selector = map[string]string{
-			"statefulset.kubernetes.io/pod-name": isvc.Spec.NodeNames[0],
+	svcType := isvc.Spec.Type
+	if svcType == "" {
+		svcType = v1.ServiceTypeLoadBalancer
+	}
+
+	trafficPolicy := isvc.Spec.ExternalTrafficPolicy
+	if trafficPolicy == "" {
+		trafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	}
+	if r.needsNetworkPolicy(isvc) {
+		// the clients' IPs must be visible to the NetworkPolicy
+		trafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	}
+
+	// apply the same defaults as the apiserver to avoid
+	// unneeded service updates
+	sessionAffinity := isvc.Spec.SessionAffinity
+	var sessionAffinityConfig *v1.SessionAffinityConfig
+	switch sessionAffinity {
+	case v1.ServiceAffinityClientIP:
+		sessionAffinityConfig = isvc.Spec.SessionAffinityConfig.DeepCopy()
+		if sessionAffinityConfig == nil {
+			sessionAffinityConfig = &v1.SessionAffinityConfig{}
 		}
+		if sessionAffinityConfig.ClientIP == nil {
+			sessionAffinityConfig.ClientIP = &v1.ClientIPConfig{}
+		}
+		if sessionAffinityConfig.ClientIP.TimeoutSeconds == nil {
+			timeout := int32(v1.DefaultClientIPServiceAffinitySeconds)
+			sessionAffinityConfig.ClientIP.TimeoutSeconds = &timeout
+		}
+	case "":
+		sessionAffinity = v1.ServiceAffinityNone
 	}
+
 	var ports []v1.ServicePort
 	for _, p := range isvc.Spec.Ports {
 		ports = append(ports, v1.ServicePort{
@@ -224,15 +623,23 @@ func (r *reconciler) makeService(isvc *v1alpha1.InnerService) *v1.Service {
 		})
 	}
 
-	return &v1.Service{
+	svc := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: r.targetNamespace,
-			Name:      isvc.Name,
+			Namespace:   r.targetNamespace,
+			Name:        isvc.Name,
+			Labels:      clusterLabels(isvc),
+			Annotations: originAnnotations(isvc),
 		},
 		Spec: v1.ServiceSpec{
-			Type:     "LoadBalancer",
-			Ports:    ports,
-			Selector: selector,
+			Type:                     svcType,
+			Ports:                    ports,
+			ExternalTrafficPolicy:    trafficPolicy,
+			LoadBalancerIP:           isvc.Spec.LoadBalancerIP,
+			LoadBalancerSourceRanges: isvc.Spec.LoadBalancerSourceRanges,
+			SessionAffinity:          sessionAffinity,
+			SessionAffinityConfig:    sessionAffinityConfig,
 		},
 	}
+	r.applyPassthroughMetadata(svc, isvc)
+	return svc
 }
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outer
+
+import (
+	"context"
+	"fmt"
+
+	"admiralty.io/multicluster-controller/pkg/controller"
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+	"github.com/ivan4th/virtletlb/pkg/sweeper"
+)
+
+// NewSweeper returns a Sweeper that deletes the managed outer
+// LoadBalancer services, Endpoints and NetworkPolicies which have
+// no corresponding InnerServices, and makes the controller recreate
+// the missing outer services. If the InnerIngresses are enabled, it
+// also deletes the outer objects of the missing InnerIngresses. The
+// client must read directly from the apiserver rather than from the
+// cache, as the sweeper runs before the cache is synced.
+func NewSweeper(co *controller.Controller, clusterName string, c client.Client, targetNamespace string, opts Options, sweepOpts sweeper.Options) *sweeper.Sweeper {
+	r := &reconciler{
+		client:          c,
+		clusterName:     clusterName,
+		targetNamespace: targetNamespace,
+		networkPolicies: opts.NetworkPolicies,
+		ingresses:       opts.Ingresses,
+	}
+	return sweeper.New("outer", sweepOpts, func(s *sweeper.Sweeper) error {
+		return r.sweep(s, func(nsn types.NamespacedName) {
+			co.Queue.Add(reconcile.Request{
+				Context:        clusterName,
+				NamespacedName: nsn,
+			})
+		})
+	})
+}
+
+func (r *reconciler) sweep(s *sweeper.Sweeper, enqueue func(types.NamespacedName)) error {
+	// the outer objects go first, see the sweeper package doc
+	var svcs v1.ServiceList
+	if err := r.client.List(context.TODO(), client.InNamespace(r.targetNamespace), &svcs); err != nil {
+		return fmt.Errorf("error listing services: %v", err)
+	}
+	var eps v1.EndpointsList
+	if err := r.client.List(context.TODO(), client.InNamespace(r.targetNamespace), &eps); err != nil {
+		return fmt.Errorf("error listing endpoints: %v", err)
+	}
+	var nps networkingv1.NetworkPolicyList
+	if r.networkPolicies {
+		if err := r.client.List(context.TODO(), client.InNamespace(r.targetNamespace), &nps); err != nil {
+			return fmt.Errorf("error listing NetworkPolicies: %v", err)
+		}
+	}
+
+	var isvcs v1alpha1.InnerServiceList
+	if err := r.client.List(context.TODO(), &client.ListOptions{}, &isvcs); err != nil {
+		return fmt.Errorf("error listing InnerServices: %v", err)
+	}
+	wanted := make(map[string]bool)
+	for _, isvc := range isvcs.Items {
+		wanted[r.targetNamespacedName(types.NamespacedName{Namespace: isvc.Namespace, Name: isvc.Name}).Name] = true
+	}
+	var iings v1alpha1.InnerIngressList
+	if r.ingresses {
+		if err := r.client.List(context.TODO(), &client.ListOptions{}, &iings); err != nil {
+			return fmt.Errorf("error listing InnerIngresses: %v", err)
+		}
+	}
+	wantedIngresses := make(map[string]bool)
+	for _, iing := range iings.Items {
+		wantedIngresses[r.targetNamespacedName(types.NamespacedName{Namespace: iing.Namespace, Name: iing.Name}).Name] = true
+	}
+
+	// the objects made for the InnerIngresses are only handled
+	// below if the InnerIngresses are enabled
+	orphan := func(obj metav1.Object) bool {
+		return managed(obj) && !ingressObject(obj) && !wanted[obj.GetName()]
+	}
+	nsnFor := func(obj metav1.Object) types.NamespacedName {
+		return types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	}
+
+	found := make(map[string]bool)
+	for n := range svcs.Items {
+		svc := &svcs.Items[n]
+		if r.ingresses && ingressObject(svc) && !wantedIngresses[svc.Name] && svc.DeletionTimestamp == nil {
+			if err := s.Delete("Ingress", nsnFor(svc).String(), func() error {
+				_, err := r.deleteIngressObjects(nsnFor(svc))
+				return err
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		if !managed(svc) || ingressObject(svc) {
+			continue
+		}
+		found[svc.Name] = true
+		if !orphan(svc) || svc.DeletionTimestamp != nil {
+			continue
+		}
+		if err := s.Delete("Service", nsnFor(svc).String(), func() error {
+			_, err := r.deleteService(nsnFor(svc))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	for n := range eps.Items {
+		ep := &eps.Items[n]
+		if !orphan(ep) || found[ep.Name] {
+			continue
+		}
+		if err := s.Delete("Endpoints", nsnFor(ep).String(), func() error {
+			return r.deleteEndpoints(nsnFor(ep))
+		}); err != nil {
+			return err
+		}
+	}
+
+	for n := range nps.Items {
+		np := &nps.Items[n]
+		if !orphan(np) || found[np.Name] {
+			continue
+		}
+		if err := s.Delete("NetworkPolicy", nsnFor(np).String(), func() error {
+			return r.syncNetworkPolicy(nsnFor(np), nil)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, isvc := range isvcs.Items {
+		nsn := types.NamespacedName{Namespace: isvc.Namespace, Name: isvc.Name}
+		if isvc.DeletionTimestamp == nil && !found[r.targetNamespacedName(nsn).Name] {
+			s.Resync("Service", r.targetNamespacedName(nsn).String(), func() { enqueue(nsn) })
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package finalizer
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Has returns true if the object has the specified finalizer
+func Has(obj metav1.Object, name string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds the finalizer to the object unless it's already there.
+// It returns true if the object was changed.
+func Add(obj metav1.Object, name string) bool {
+	if Has(obj, name) {
+		return false
+	}
+	obj.SetFinalizers(append(obj.GetFinalizers(), name))
+	return true
+}
+
+// Remove removes the finalizer from the object. It returns true if
+// the object was changed.
+func Remove(obj metav1.Object, name string) bool {
+	if !Has(obj, name) {
+		return false
+	}
+	var finalizers []string
+	for _, f := range obj.GetFinalizers() {
+		if f != name {
+			finalizers = append(finalizers, f)
+		}
+	}
+	obj.SetFinalizers(finalizers)
+	return true
+}
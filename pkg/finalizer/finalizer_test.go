@@ -0,0 +1,50 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package finalizer
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFinalizers(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Finalizers: []string{"other"},
+		},
+	}
+	g.Expect(Has(svc, "foo")).To(gomega.BeFalse())
+
+	g.Expect(Add(svc, "foo")).To(gomega.BeTrue())
+	g.Expect(Has(svc, "foo")).To(gomega.BeTrue())
+	// adding the finalizer again doesn't change the object
+	g.Expect(Add(svc, "foo")).To(gomega.BeFalse())
+	g.Expect(svc.Finalizers).To(gomega.Equal([]string{"other", "foo"}))
+
+	g.Expect(Remove(svc, "foo")).To(gomega.BeTrue())
+	g.Expect(Has(svc, "foo")).To(gomega.BeFalse())
+	// removing it again doesn't change the object either
+	g.Expect(Remove(svc, "foo")).To(gomega.BeFalse())
+	g.Expect(svc.Finalizers).To(gomega.Equal([]string{"other"}))
+
+	g.Expect(Remove(svc, "other")).To(gomega.BeTrue())
+	g.Expect(svc.Finalizers).To(gomega.BeEmpty())
+}
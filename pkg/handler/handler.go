@@ -0,0 +1,64 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handler
+
+import (
+	"admiralty.io/multicluster-controller/pkg/reconcile"
+	clientcache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// EnqueueRequestsFromMapFunc is an event handler that enqueues
+// the reconcile requests returned by ToRequests for each watched
+// object. It's used when changes in the watched objects must
+// trigger reconciliation of other objects which can't be found
+// using owner references. If UpdateFilter is set, the updates for
+// which it returns false are ignored, which helps with the objects
+// that are updated often, e.g. the Nodes.
+type EnqueueRequestsFromMapFunc struct {
+	Queue        workqueue.RateLimitingInterface
+	ToRequests   func(obj interface{}) []reconcile.Request
+	UpdateFilter func(oldObj, newObj interface{}) bool
+}
+
+// OnAdd implements OnAdd method of clientcache.ResourceEventHandler
+func (e *EnqueueRequestsFromMapFunc) OnAdd(obj interface{}) {
+	e.enqueue(obj)
+}
+
+// OnUpdate implements OnUpdate method of clientcache.ResourceEventHandler
+func (e *EnqueueRequestsFromMapFunc) OnUpdate(oldObj, newObj interface{}) {
+	if e.UpdateFilter != nil && !e.UpdateFilter(oldObj, newObj) {
+		return
+	}
+	e.enqueue(oldObj)
+	e.enqueue(newObj)
+}
+
+// OnDelete implements OnDelete method of clientcache.ResourceEventHandler
+func (e *EnqueueRequestsFromMapFunc) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(clientcache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	e.enqueue(obj)
+}
+
+func (e *EnqueueRequestsFromMapFunc) enqueue(obj interface{}) {
+	for _, req := range e.ToRequests(obj) {
+		e.Queue.Add(req)
+	}
+}
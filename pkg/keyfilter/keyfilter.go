@@ -0,0 +1,119 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keyfilter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter matches label and annotation keys against an allow-list
+type Filter struct {
+	exact    map[string]bool
+	prefixes []string
+	regexps  []*regexp.Regexp
+}
+
+// Parse parses a comma-separated allow-list of key patterns. A
+// pattern that starts with "^" is a regular expression, a pattern
+// that ends with "*" is a key prefix and any other pattern must
+// match the key exactly. The commas inside the braces and the
+// brackets of the regular expressions, e.g. in "{1,3}" quantifiers,
+// don't separate the patterns. An empty list matches no keys.
+func Parse(patterns string) (*Filter, error) {
+	f := &Filter{exact: make(map[string]bool)}
+	for _, p := range splitPatterns(patterns) {
+		p = strings.TrimSpace(p)
+		switch {
+		case p == "":
+			continue
+		case strings.HasPrefix(p, "^"):
+			rx, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("bad key pattern %q: %v", p, err)
+			}
+			f.regexps = append(f.regexps, rx)
+		case strings.HasSuffix(p, "*"):
+			f.prefixes = append(f.prefixes, strings.TrimSuffix(p, "*"))
+		default:
+			f.exact[p] = true
+		}
+	}
+	return f, nil
+}
+
+// splitPatterns splits the comma-separated list of patterns,
+// skipping the commas inside the braces and the brackets
+func splitPatterns(patterns string) []string {
+	var r []string
+	depth, start := 0, 0
+	for i, c := range patterns {
+		switch c {
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				r = append(r, patterns[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(r, patterns[start:])
+}
+
+// Match returns true if the key is allowed by the filter. A nil
+// filter doesn't match any keys.
+func (f *Filter) Match(key string) bool {
+	if f == nil {
+		return false
+	}
+	if f.exact[key] {
+		return true
+	}
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	for _, rx := range f.regexps {
+		if rx.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns a map with the entries of m whose keys are
+// allowed by the filter, or nil if there are no such entries
+func (f *Filter) Apply(m map[string]string) map[string]string {
+	var r map[string]string
+	for k, v := range m {
+		if !f.Match(k) {
+			continue
+		}
+		if r == nil {
+			r = make(map[string]string)
+		}
+		r[k] = v
+	}
+	return r
+}
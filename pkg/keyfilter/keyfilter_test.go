@@ -0,0 +1,67 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keyfilter
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestFilter(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	f, err := Parse("metallb.universe.tf/address-pool, example.com/* ,^team\\.[a-z]+/owner$")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	for key, expected := range map[string]bool{
+		"metallb.universe.tf/address-pool":    true,
+		"metallb.universe.tf/allow-shared-ip": false,
+		"example.com/foo":                     true,
+		"example.com":                         false,
+		"team.infra/owner":                    true,
+		"team.infra/owner2":                   false,
+		"":                                    false,
+	} {
+		g.Expect(f.Match(key)).To(gomega.Equal(expected), "key %q", key)
+	}
+
+	g.Expect(f.Apply(map[string]string{
+		"example.com/foo": "bar",
+		"other":           "baz",
+	})).To(gomega.Equal(map[string]string{"example.com/foo": "bar"}))
+	g.Expect(f.Apply(map[string]string{"other": "baz"})).To(gomega.BeNil())
+
+	var nilFilter *Filter
+	g.Expect(nilFilter.Match("example.com/foo")).To(gomega.BeFalse())
+
+	_, err = Parse("^(")
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	// the commas of the quantifiers don't split the patterns
+	f, err = Parse("^[a-z]{2,3}/id$,^x[,;]y$,foo")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	for key, expected := range map[string]bool{
+		"ab/id":   true,
+		"abcd/id": false,
+		"x,y":     true,
+		"foo":     true,
+		"3}/id$":  false,
+	} {
+		g.Expect(f.Match(key)).To(gomega.Equal(expected), "key %q", key)
+	}
+}
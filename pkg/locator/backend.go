@@ -0,0 +1,172 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package locator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// StatefulSetBackend is used for the VMs or nested cluster
+	// nodes that are pods named after the backends, e.g. the pods
+	// of a StatefulSet of Virtlet VMs
+	StatefulSetBackend = "statefulset"
+	// KubeVirtBackend is used for KubeVirt VirtualMachineInstances.
+	// The backend names are the VMI names which are resolved to the
+	// corresponding virt-launcher pods.
+	KubeVirtBackend = "kubevirt"
+	// PodBackend is used for generic pods, e.g. Kata pods or the
+	// pods of pod-based nested clusters. The pods are found by the
+	// label that holds the backend name.
+	PodBackend = "pod"
+
+	// DefaultBackendLabel is the default label of the pods of the
+	// generic pod backend
+	DefaultBackendLabel = "virtletlb.virtlet.cloud/backend"
+
+	statefulSetPodNameLabel = "statefulset.kubernetes.io/pod-name"
+
+	kubeVirtLabel       = "kubevirt.io"
+	kubeVirtLauncher    = "virt-launcher"
+	kubeVirtDomainLabel = "kubevirt.io/domain"
+)
+
+// BackendKinds lists the supported backend kinds
+var BackendKinds = []string{StatefulSetBackend, KubeVirtBackend, PodBackend}
+
+// Backend finds the outer pods by the backend names. The backend
+// name identifies a VM or a nested cluster node in the outer
+// cluster, and the NodeLocator finds it for an inner node.
+type Backend interface {
+	// Pod returns the pod of the backend with the specified name,
+	// or nil if there's no such pod
+	Pod(name string) (*v1.Pod, error)
+	// Name returns the name of the backend the pod belongs to, or
+	// an empty string if it's not a backend pod
+	Name(pod *v1.Pod) string
+	// NameLabel returns the label of the backend pods that holds
+	// the backend name, e.g. for the NetworkPolicy pod selectors.
+	// Note that the pods of the StatefulSet backend may lack it if
+	// they don't belong to a StatefulSet.
+	NameLabel() string
+}
+
+// NewBackend makes a Backend of the specified kind which looks for
+// the pods in the specified namespace. label is only used by the
+// generic pod backend and defaults to DefaultBackendLabel.
+func NewBackend(kind string, c client.Client, namespace, label string) (Backend, error) {
+	switch kind {
+	case StatefulSetBackend:
+		return &statefulSetBackend{c: c, namespace: namespace}, nil
+	case KubeVirtBackend:
+		return &labelBackend{
+			c:         c,
+			namespace: namespace,
+			label:     kubeVirtDomainLabel,
+			selector:  map[string]string{kubeVirtLabel: kubeVirtLauncher},
+		}, nil
+	case PodBackend:
+		if label == "" {
+			label = DefaultBackendLabel
+		}
+		return &labelBackend{c: c, namespace: namespace, label: label}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q (must be one of: %s)", kind, strings.Join(BackendKinds, ", "))
+	}
+}
+
+type statefulSetBackend struct {
+	c         client.Client
+	namespace string
+}
+
+func (b *statefulSetBackend) Pod(name string) (*v1.Pod, error) {
+	return getPod(b.c, b.namespace, name)
+}
+
+func (b *statefulSetBackend) Name(pod *v1.Pod) string {
+	if pod.Namespace != b.namespace {
+		return ""
+	}
+	return pod.Name
+}
+
+func (b *statefulSetBackend) NameLabel() string {
+	return statefulSetPodNameLabel
+}
+
+// labelBackend finds the backend pods by the label that holds the
+// backend name. If selector is set, the pods must have these
+// labels, too.
+type labelBackend struct {
+	c         client.Client
+	namespace string
+	label     string
+	selector  map[string]string
+}
+
+func (b *labelBackend) Pod(name string) (*v1.Pod, error) {
+	if name == "" {
+		return nil, nil
+	}
+	pods, err := findPods(b.c, b.namespace, func(pod *v1.Pod) bool {
+		return b.Name(pod) == name
+	})
+	if err != nil || len(pods) == 0 {
+		return nil, err
+	}
+	// there may be several pods for the same backend, e.g. during
+	// KubeVirt live migration, or while a pod is being replaced
+	sort.SliceStable(pods, func(i, j int) bool { return PreferPod(pods[i], pods[j]) })
+	return pods[0], nil
+}
+
+// PreferPod returns true if pod a is preferred over pod b when both
+// belong to the same backend. The live pods are preferred, then the
+// running ones, then the newest ones.
+func PreferPod(a, b *v1.Pod) bool {
+	if PodAlive(a) != PodAlive(b) {
+		return PodAlive(a)
+	}
+	aRunning := a.Status.Phase == v1.PodRunning
+	bRunning := b.Status.Phase == v1.PodRunning
+	if aRunning != bRunning {
+		return aRunning
+	}
+	return b.CreationTimestamp.Before(&a.CreationTimestamp)
+}
+
+func (b *labelBackend) Name(pod *v1.Pod) string {
+	if pod.Namespace != b.namespace {
+		return ""
+	}
+	for k, v := range b.selector {
+		if pod.Labels[k] != v {
+			return ""
+		}
+	}
+	return pod.Labels[b.label]
+}
+
+func (b *labelBackend) NameLabel() string {
+	return b.label
+}
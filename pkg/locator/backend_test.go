@@ -0,0 +1,159 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package locator
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+// loadFixture makes a fake client with the pods from the
+// testdata/<kind>.yaml file
+func loadFixture(t *testing.T, kind string) client.Client {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", kind+".yaml"))
+	if err != nil {
+		t.Fatalf("error reading the fixture: %v", err)
+	}
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		t.Fatalf("error decoding the fixture: %v", err)
+	}
+	pods, ok := obj.(*v1.PodList)
+	if !ok {
+		t.Fatalf("the fixture is not a PodList: %T", obj)
+	}
+	var objs []runtime.Object
+	for n := range pods.Items {
+		objs = append(objs, &pods.Items[n])
+	}
+	return fake.NewFakeClient(objs...)
+}
+
+func podName(pod *v1.Pod) string {
+	if pod == nil {
+		return ""
+	}
+	return pod.Name
+}
+
+func TestBackends(t *testing.T) {
+	for _, tc := range []struct {
+		kind string
+		// pods maps the backend names to the expected pod names
+		pods map[string]string
+	}{
+		{
+			kind: StatefulSetBackend,
+			pods: map[string]string{
+				"k8s-0": "k8s-0",
+				"k8s-1": "k8s-1",
+				"k8s-2": "",
+				"":      "",
+			},
+		},
+		{
+			kind: KubeVirtBackend,
+			pods: map[string]string{
+				"vm-0": "virt-launcher-vm-0-x7k2p",
+				"vm-1": "virt-launcher-vm-1-fghij",
+				"vm-2": "",
+				"vm-3": "",
+			},
+		},
+		{
+			kind: PodBackend,
+			pods: map[string]string{
+				"node-a":    "nested-node-7d9f8-abc12",
+				"node-b":    "nested-node-7d9f8-def34",
+				"unrelated": "",
+			},
+		},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			c := loadFixture(t, tc.kind)
+			backend, err := NewBackend(tc.kind, c, "default", "")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			for name, expected := range tc.pods {
+				pod, err := backend.Pod(name)
+				g.Expect(err).NotTo(gomega.HaveOccurred())
+				g.Expect(podName(pod)).To(gomega.Equal(expected), "backend %q", name)
+				if pod != nil {
+					g.Expect(backend.Name(pod)).To(gomega.Equal(name))
+					// the pods can be selected by the name label
+					g.Expect(pod.Labels[backend.NameLabel()]).To(gomega.Equal(name))
+				}
+			}
+
+			// the node locators find the pods via the backend
+			for name, expected := range tc.pods {
+				if name == "" {
+					continue
+				}
+				for _, l := range []struct {
+					kind string
+					node v1alpha1.InnerServiceNode
+				}{
+					{NodeName, v1alpha1.InnerServiceNode{Name: name}},
+					{ProviderID, v1alpha1.InnerServiceNode{Name: "n", ProviderID: "virtlet://default/" + name}},
+					{PodRef, v1alpha1.InnerServiceNode{Name: "n", PodRef: name}},
+				} {
+					nl, err := New(l.kind, backend, c, "default")
+					g.Expect(err).NotTo(gomega.HaveOccurred())
+					pod, err := nl.Locate(l.node)
+					g.Expect(err).NotTo(gomega.HaveOccurred())
+					g.Expect(podName(pod)).To(gomega.Equal(expected), "locator %q, backend %q", l.kind, name)
+					if pod != nil {
+						g.Expect(nl.Matches(pod, l.node)).To(gomega.BeTrue())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBackendNameLabels(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, tc := range []struct {
+		kind, label, expected string
+	}{
+		{StatefulSetBackend, "", "statefulset.kubernetes.io/pod-name"},
+		{KubeVirtBackend, "", "kubevirt.io/domain"},
+		{PodBackend, "", DefaultBackendLabel},
+		{PodBackend, "example.com/node", "example.com/node"},
+	} {
+		backend, err := NewBackend(tc.kind, fake.NewFakeClient(), "default", tc.label)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(backend.NameLabel()).To(gomega.Equal(tc.expected), "backend %q", tc.kind)
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, err := NewBackend("foobar", fake.NewFakeClient(), "default", "")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package locator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+const (
+	// NodeName locator takes the backend name from the name of the
+	// inner node, which is the case for the VMs made by a StatefulSet
+	NodeName = "node-name"
+	// StatefulSet is the old name of the NodeName locator which is
+	// still accepted for compatibility
+	StatefulSet = "statefulset"
+	// ProviderID locator takes the backend name from the last
+	// component of the node's spec.providerID, optionally preceded
+	// by the namespace, e.g. virtlet://namespace/pod-name
+	ProviderID = "provider-id"
+	// PodRef locator takes the backend name or the UID of the outer
+	// pod from the node's label or annotation
+	PodRef = "pod-ref"
+	// InternalIP locator matches the InternalIP of the node against
+	// the IPs of the outer pods
+	InternalIP = "internal-ip"
+)
+
+// Kinds lists the supported locator kinds
+var Kinds = []string{NodeName, ProviderID, PodRef, InternalIP}
+
+// NodeLocator finds the outer pods that correspond to the inner nodes
+type NodeLocator interface {
+	// Locate returns the outer pod that corresponds to the inner
+	// node, or nil if there's no such pod
+	Locate(node v1alpha1.InnerServiceNode) (*v1.Pod, error)
+	// Matches returns true if the outer pod corresponds to the
+	// inner node
+	Matches(pod *v1.Pod, node v1alpha1.InnerServiceNode) bool
+}
+
+// New makes a NodeLocator of the specified kind which uses the
+// backend to find the pods in the specified namespace
+func New(kind string, backend Backend, c client.Client, namespace string) (NodeLocator, error) {
+	switch kind {
+	case NodeName, StatefulSet:
+		return &nodeNameLocator{backend: backend}, nil
+	case ProviderID:
+		return &providerIDLocator{backend: backend, namespace: namespace}, nil
+	case PodRef:
+		return &podRefLocator{backend: backend, c: c, namespace: namespace}, nil
+	case InternalIP:
+		return &internalIPLocator{c: c, namespace: namespace}, nil
+	default:
+		return nil, fmt.Errorf("unknown node locator %q (must be one of: %s)", kind, strings.Join(Kinds, ", "))
+	}
+}
+
+func getPod(c client.Client, namespace, name string) (*v1.Pod, error) {
+	if name == "" {
+		return nil, nil
+	}
+	pod := &v1.Pod{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, pod); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pod, nil
+}
+
+// findPods returns the pods in the namespace that satisfy the
+// predicate
+func findPods(c client.Client, namespace string, pred func(pod *v1.Pod) bool) ([]*v1.Pod, error) {
+	var pods v1.PodList
+	if err := c.List(context.TODO(), client.InNamespace(namespace), &pods); err != nil {
+		return nil, err
+	}
+	var r []*v1.Pod
+	for n := range pods.Items {
+		if pred(&pods.Items[n]) {
+			r = append(r, &pods.Items[n])
+		}
+	}
+	return r, nil
+}
+
+// findPod returns the first pod in the namespace that satisfies
+// the predicate
+func findPod(c client.Client, namespace string, pred func(pod *v1.Pod) bool) (*v1.Pod, error) {
+	pods, err := findPods(c, namespace, pred)
+	if err != nil || len(pods) == 0 {
+		return nil, err
+	}
+	return pods[0], nil
+}
+
+type nodeNameLocator struct {
+	backend Backend
+}
+
+func (l *nodeNameLocator) Locate(node v1alpha1.InnerServiceNode) (*v1.Pod, error) {
+	return l.backend.Pod(node.Name)
+}
+
+func (l *nodeNameLocator) Matches(pod *v1.Pod, node v1alpha1.InnerServiceNode) bool {
+	return l.backend.Name(pod) == node.Name
+}
+
+type providerIDLocator struct {
+	backend   Backend
+	namespace string
+}
+
+// ParseProviderID returns the backend name from the provider ID,
+// which is the last component of the ID, optionally preceded by the
+// namespace, e.g. virtlet://namespace/pod-name. It returns an empty
+// string if the provider ID refers to a different namespace.
+func ParseProviderID(providerID, namespace string) string {
+	if n := strings.Index(providerID, "://"); n >= 0 {
+		providerID = providerID[n+3:]
+	}
+	parts := strings.Split(strings.Trim(providerID, "/"), "/")
+	name := parts[len(parts)-1]
+	if len(parts) > 1 && parts[len(parts)-2] != namespace {
+		return ""
+	}
+	return name
+}
+
+func (l *providerIDLocator) backendName(node v1alpha1.InnerServiceNode) string {
+	return ParseProviderID(node.ProviderID, l.namespace)
+}
+
+func (l *providerIDLocator) Locate(node v1alpha1.InnerServiceNode) (*v1.Pod, error) {
+	name := l.backendName(node)
+	if name == "" {
+		return nil, nil
+	}
+	return l.backend.Pod(name)
+}
+
+func (l *providerIDLocator) Matches(pod *v1.Pod, node v1alpha1.InnerServiceNode) bool {
+	name := l.backendName(node)
+	return name != "" && l.backend.Name(pod) == name
+}
+
+type podRefLocator struct {
+	backend   Backend
+	c         client.Client
+	namespace string
+}
+
+func (l *podRefLocator) Locate(node v1alpha1.InnerServiceNode) (*v1.Pod, error) {
+	if node.PodRef == "" {
+		return nil, nil
+	}
+	pod, err := l.backend.Pod(node.PodRef)
+	if err != nil || pod != nil {
+		return pod, err
+	}
+	// not a backend name, try it as the UID of the pod
+	return findPod(l.c, l.namespace, func(pod *v1.Pod) bool {
+		return string(pod.UID) == node.PodRef
+	})
+}
+
+func (l *podRefLocator) Matches(pod *v1.Pod, node v1alpha1.InnerServiceNode) bool {
+	return node.PodRef != "" && pod.Namespace == l.namespace &&
+		(l.backend.Name(pod) == node.PodRef || string(pod.UID) == node.PodRef)
+}
+
+type internalIPLocator struct {
+	c         client.Client
+	namespace string
+}
+
+func (l *internalIPLocator) Locate(node v1alpha1.InnerServiceNode) (*v1.Pod, error) {
+	if node.InternalIP == "" {
+		return nil, nil
+	}
+	return findPod(l.c, l.namespace, func(pod *v1.Pod) bool {
+		return l.Matches(pod, node)
+	})
+}
+
+func (l *internalIPLocator) Matches(pod *v1.Pod, node v1alpha1.InnerServiceNode) bool {
+	// the IPs of the pods that are gone may be reused
+	if !PodAlive(pod) {
+		return false
+	}
+	return node.InternalIP != "" && pod.Namespace == l.namespace && pod.Status.PodIP == node.InternalIP
+}
+
+// PodAlive returns false if the pod is being deleted or has
+// terminated
+func PodAlive(pod *v1.Pod) bool {
+	return pod.DeletionTimestamp == nil && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package locator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/ivan4th/virtletlb/pkg/apis/virtletlb/v1alpha1"
+)
+
+func TestParseProviderID(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, tc := range []struct {
+		providerID, expected string
+	}{
+		{"virtlet://default/k8s-0", "k8s-0"},
+		{"kubevirt://default/vm-0", "vm-0"},
+		{"virtlet://default/k8s-0/", "k8s-0"},
+		{"virtlet://k8s-0", "k8s-0"},
+		{"default/k8s-0", "k8s-0"},
+		{"k8s-0", "k8s-0"},
+		// the pods of the other namespaces are never used
+		{"virtlet://other/k8s-0", ""},
+		{"aws:///us-east-1a/i-0123456789", ""},
+		{"", ""},
+	} {
+		g.Expect(ParseProviderID(tc.providerID, "default")).To(gomega.Equal(tc.expected), "provider ID %q", tc.providerID)
+	}
+}
+
+func TestNodeLocators(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		kind string
+		node v1alpha1.InnerServiceNode
+		// expected is the name of the pod that must be found,
+		// if any
+		expected string
+	}{
+		{
+			name:     "node name",
+			kind:     NodeName,
+			node:     v1alpha1.InnerServiceNode{Name: "k8s-0"},
+			expected: "k8s-0",
+		},
+		{
+			name: "node name of a pod in another namespace",
+			kind: NodeName,
+			node: v1alpha1.InnerServiceNode{Name: "k8s-2"},
+		},
+		{
+			name: "unknown node name",
+			kind: NodeName,
+			node: v1alpha1.InnerServiceNode{Name: "node-x"},
+		},
+		{
+			name:     "provider ID",
+			kind:     ProviderID,
+			node:     v1alpha1.InnerServiceNode{Name: "n", ProviderID: "virtlet://default/k8s-1"},
+			expected: "k8s-1",
+		},
+		{
+			name: "provider ID with another namespace",
+			kind: ProviderID,
+			node: v1alpha1.InnerServiceNode{Name: "n", ProviderID: "virtlet://other/k8s-2"},
+		},
+		{
+			name: "no provider ID",
+			kind: ProviderID,
+			node: v1alpha1.InnerServiceNode{Name: "k8s-0"},
+		},
+		{
+			name:     "pod ref with the backend name",
+			kind:     PodRef,
+			node:     v1alpha1.InnerServiceNode{Name: "n", PodRef: "k8s-0"},
+			expected: "k8s-0",
+		},
+		{
+			name:     "pod ref with the pod UID",
+			kind:     PodRef,
+			node:     v1alpha1.InnerServiceNode{Name: "n", PodRef: "9c0a7e3c-0000-0000-0000-000000000002"},
+			expected: "k8s-1",
+		},
+		{
+			name: "pod ref with the UID of a pod in another namespace",
+			kind: PodRef,
+			node: v1alpha1.InnerServiceNode{Name: "n", PodRef: "9c0a7e3c-0000-0000-0000-000000000003"},
+		},
+		{
+			name: "no pod ref",
+			kind: PodRef,
+			node: v1alpha1.InnerServiceNode{Name: "k8s-0"},
+		},
+		{
+			name:     "internal IP",
+			kind:     InternalIP,
+			node:     v1alpha1.InnerServiceNode{Name: "n", InternalIP: "10.244.2.10"},
+			expected: "k8s-1",
+		},
+		{
+			name: "internal IP of a pod in another namespace",
+			kind: InternalIP,
+			node: v1alpha1.InnerServiceNode{Name: "n", InternalIP: "10.244.3.10"},
+		},
+		{
+			name: "no internal IP",
+			kind: InternalIP,
+			node: v1alpha1.InnerServiceNode{Name: "k8s-0"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+			c := loadFixture(t, StatefulSetBackend)
+			backend, err := NewBackend(StatefulSetBackend, c, "default", "")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			nl, err := New(tc.kind, backend, c, "default")
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+
+			pod, err := nl.Locate(tc.node)
+			g.Expect(err).NotTo(gomega.HaveOccurred())
+			g.Expect(podName(pod)).To(gomega.Equal(tc.expected))
+
+			// only the located pod matches the node
+			var pods v1.PodList
+			g.Expect(c.List(context.TODO(), &client.ListOptions{}, &pods)).To(gomega.Succeed())
+			for n := range pods.Items {
+				p := &pods.Items[n]
+				g.Expect(nl.Matches(p, tc.node)).To(gomega.Equal(p.Name == tc.expected), "pod %s/%s", p.Namespace, p.Name)
+			}
+		})
+	}
+}
+
+func TestInternalIPLocatorSkipsDeadPods(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	c := loadFixture(t, KubeVirtBackend)
+	nl, err := New(InternalIP, nil, c, "default")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	// the IP belongs to a pod that has terminated
+	node := v1alpha1.InnerServiceNode{Name: "vm-1", InternalIP: "10.244.1.21"}
+	pod, err := nl.Locate(node)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(pod).To(gomega.BeNil())
+
+	// the IP is reused by a new pod
+	g.Expect(c.Create(context.TODO(), &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "virt-launcher-vm-3-klmno",
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIP: "10.244.1.21",
+		},
+	})).To(gomega.Succeed())
+	pod, err = nl.Locate(node)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(podName(pod)).To(gomega.Equal("virt-launcher-vm-3-klmno"))
+
+	// the pods that are being deleted are skipped, too
+	now := metav1.Now()
+	pod.DeletionTimestamp = &now
+	g.Expect(nl.Matches(pod, node)).To(gomega.BeFalse())
+}
+
+func TestUnknownLocator(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, err := New("foobar", nil, nil, "default")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package names
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// MaxLength is the maximum length of a DNS label, which
+	// limits the length of the service names
+	MaxLength = 63
+	// HashLength is the number of hex digits of the hash that's
+	// appended to the shortened names
+	HashLength = 10
+)
+
+// Shorten returns the name unchanged if it fits in maxLen
+// characters. Otherwise, it truncates the name and appends a dash
+// followed by a hash of the whole name, so that different long
+// names that share the same prefix don't collide. The result
+// is deterministic and is at most maxLen characters long.
+func Shorten(name string, maxLen int) string {
+	if len(name) <= maxLen {
+		return name
+	}
+	prefix := strings.TrimRight(name[:maxLen-HashLength-1], "-.")
+	return prefix + "-" + Hash(name)
+}
+
+// Hash returns a short hex hash of the string that can be used as
+// a part of the names
+func Hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:HashLength]
+}
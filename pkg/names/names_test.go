@@ -0,0 +1,46 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package names
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestShorten(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(Shorten("k8s-default-nginx", MaxLength)).To(gomega.Equal("k8s-default-nginx"))
+	exact := strings.Repeat("a", MaxLength)
+	g.Expect(Shorten(exact, MaxLength)).To(gomega.Equal(exact))
+
+	long1 := "k8s-" + strings.Repeat("x", 60) + "-svc1"
+	long2 := "k8s-" + strings.Repeat("x", 60) + "-svc2"
+	short1 := Shorten(long1, MaxLength)
+	short2 := Shorten(long2, MaxLength)
+	g.Expect(len(short1)).To(gomega.BeNumerically("<=", MaxLength))
+	g.Expect(len(short2)).To(gomega.BeNumerically("<=", MaxLength))
+	g.Expect(short1).To(gomega.HavePrefix("k8s-xxx"))
+	g.Expect(short1).NotTo(gomega.Equal(short2))
+	g.Expect(Shorten(long1, MaxLength)).To(gomega.Equal(short1))
+
+	// no dashes before the hash
+	dashes := "k8s-" + strings.Repeat("x", 47) + strings.Repeat("-", 20)
+	g.Expect(Shorten(dashes, MaxLength)).To(gomega.MatchRegexp(`^k8s-x+-[0-9a-f]{10}$`))
+}
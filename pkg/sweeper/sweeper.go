@@ -0,0 +1,143 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sweeper runs the sweeps that clean up after the events
+// that were lost while the controllers were down.
+//
+// A SweepFunc compares the objects it manages with the objects
+// they're made for. It must list the managed objects first and
+// their sources second. An object made for a source that's created
+// in between then either isn't in the first list or has its source
+// in the second one, so it's never taken for an orphan. With the
+// opposite order, such objects would be deleted.
+package sweeper
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+var (
+	sweepsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "virtletlb",
+		Subsystem: "sweeper",
+		Name:      "sweeps_total",
+		Help:      "Number of the orphan sweeps by result.",
+	}, []string{"sweeper", "result"})
+	deletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "virtletlb",
+		Subsystem: "sweeper",
+		Name:      "deletions_total",
+		Help:      "Number of the orphaned objects deleted by the sweeper.",
+	}, []string{"sweeper", "kind"})
+	resyncsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "virtletlb",
+		Subsystem: "sweeper",
+		Name:      "resyncs_total",
+		Help:      "Number of the missing objects the sweeper requested to recreate.",
+	}, []string{"sweeper", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(sweepsTotal, deletionsTotal, resyncsTotal)
+}
+
+// Options specifies the options of a Sweeper
+type Options struct {
+	// Interval specifies how often the sweeps are run. If it's
+	// zero, the sweep is only run once at startup.
+	Interval time.Duration
+	// DeleteQPS limits the rate of the deletions. Zero means
+	// no limit.
+	DeleteQPS float64
+}
+
+// SweepFunc finds the objects that are out of sync and uses the
+// Sweeper to delete or resync them
+type SweepFunc func(s *Sweeper) error
+
+// Sweeper runs a SweepFunc at startup and then periodically.
+// It's used to clean up the objects left behind by the events
+// that were lost while the controllers were down.
+type Sweeper struct {
+	name     string
+	interval time.Duration
+	limiter  *rate.Limiter
+	sweep    SweepFunc
+}
+
+// New makes a new Sweeper with the specified name which is used
+// in the logs and the metrics
+func New(name string, opts Options, sweep SweepFunc) *Sweeper {
+	limit := rate.Inf
+	if opts.DeleteQPS > 0 {
+		limit = rate.Limit(opts.DeleteQPS)
+	}
+	return &Sweeper{
+		name:     name,
+		interval: opts.Interval,
+		limiter:  rate.NewLimiter(limit, 1),
+		sweep:    sweep,
+	}
+}
+
+// Run runs the sweeps till the stop channel is closed
+func (s *Sweeper) Run(stop <-chan struct{}) {
+	if s.interval <= 0 {
+		s.runOnce()
+		return
+	}
+	wait.Until(s.runOnce, s.interval, stop)
+}
+
+func (s *Sweeper) runOnce() {
+	klog.V(1).Infof("sweeper %s: starting the sweep", s.name)
+	if err := s.sweep(s); err != nil {
+		klog.Warningf("sweeper %s: sweep failed: %v", s.name, err)
+		sweepsTotal.WithLabelValues(s.name, "error").Inc()
+		return
+	}
+	klog.V(1).Infof("sweeper %s: sweep done", s.name)
+	sweepsTotal.WithLabelValues(s.name, "success").Inc()
+}
+
+// Delete deletes an orphaned object using the specified function,
+// obeying the rate limit
+func (s *Sweeper) Delete(kind, name string, del func() error) error {
+	if err := s.limiter.Wait(context.TODO()); err != nil {
+		return err
+	}
+	klog.Infof("sweeper %s: deleting orphaned %s %s", s.name, kind, name)
+	if err := del(); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	deletionsTotal.WithLabelValues(s.name, kind).Inc()
+	return nil
+}
+
+// Resync requests the missing object to be recreated using the
+// specified function, which usually enqueues a reconcile request
+func (s *Sweeper) Resync(kind, name string, resync func()) {
+	klog.Infof("sweeper %s: %s %s is missing, resyncing", s.name, kind, name)
+	resync()
+	resyncsTotal.WithLabelValues(s.name, kind).Inc()
+}
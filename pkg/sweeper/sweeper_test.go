@@ -0,0 +1,102 @@
+/*
+Copyright 2019 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sweeper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDelete(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := New("test-delete", Options{}, nil)
+	deleted := 0
+	g.Expect(s.Delete("Service", "default/foo", func() error {
+		deleted++
+		return nil
+	})).To(gomega.Succeed())
+	// the objects that are already gone are fine
+	g.Expect(s.Delete("Service", "default/bar", func() error {
+		deleted++
+		return errors.NewNotFound(schema.GroupResource{Resource: "services"}, "bar")
+	})).To(gomega.Succeed())
+	g.Expect(s.Delete("Service", "default/baz", func() error {
+		deleted++
+		return fmt.Errorf("oops")
+	})).To(gomega.MatchError("oops"))
+	g.Expect(deleted).To(gomega.Equal(3))
+	g.Expect(testutil.ToFloat64(deletionsTotal.WithLabelValues("test-delete", "Service"))).To(gomega.Equal(2.0))
+}
+
+func TestDeleteRateLimit(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := New("test-rate-limit", Options{DeleteQPS: 20}, nil)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		g.Expect(s.Delete("Service", fmt.Sprintf("default/svc-%d", i), func() error { return nil })).To(gomega.Succeed())
+	}
+	// the first deletion uses up the burst, the next ones are
+	// 50ms apart
+	g.Expect(time.Since(start)).To(gomega.BeNumerically(">=", 150*time.Millisecond))
+	g.Expect(testutil.ToFloat64(deletionsTotal.WithLabelValues("test-rate-limit", "Service"))).To(gomega.Equal(5.0))
+}
+
+func TestResync(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := New("test-resync", Options{}, nil)
+	resynced := 0
+	s.Resync("InnerService", "outer/k8s-default-foo", func() { resynced++ })
+	g.Expect(resynced).To(gomega.Equal(1))
+	g.Expect(testutil.ToFloat64(resyncsTotal.WithLabelValues("test-resync", "InnerService"))).To(gomega.Equal(1.0))
+}
+
+func TestRun(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	var err error
+	sweeps := 0
+	s := New("test-run", Options{}, func(s *Sweeper) error {
+		sweeps++
+		return err
+	})
+	// with zero interval, Run only sweeps once
+	s.Run(nil)
+	err = fmt.Errorf("oops")
+	s.Run(nil)
+	g.Expect(sweeps).To(gomega.Equal(2))
+	g.Expect(testutil.ToFloat64(sweepsTotal.WithLabelValues("test-run", "success"))).To(gomega.Equal(1.0))
+	g.Expect(testutil.ToFloat64(sweepsTotal.WithLabelValues("test-run", "error"))).To(gomega.Equal(1.0))
+
+	// with nonzero interval, it sweeps till stopped
+	sweeps = 0
+	err = nil
+	stop := make(chan struct{})
+	s = New("test-run-periodic", Options{Interval: 10 * time.Millisecond}, func(s *Sweeper) error {
+		sweeps++
+		if sweeps == 3 {
+			close(stop)
+		}
+		return nil
+	})
+	s.Run(stop)
+	g.Expect(sweeps).To(gomega.Equal(3))
+}
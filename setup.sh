@@ -20,6 +20,7 @@ virtletctl ssh root@k8s-0 -- \
 
 kubectl apply \
         -f config/crds/virtletlb_v1alpha1_innerservice.yaml \
+        -f config/crds/virtletlb_v1alpha1_inneringress.yaml \
         -f https://raw.githubusercontent.com/google/metallb/v0.7.3/manifests/metallb.yaml \
         -f metallb-conf.yaml 
 